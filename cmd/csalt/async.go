@@ -0,0 +1,194 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	asyncJIDPrefix      = "Executed command with job ID: "
+	defaultWaitInterval = 30 * time.Second
+	// maxOutstandingShown limits how many outstanding devices wait lists after each poll
+	maxOutstandingShown = 10
+)
+
+type WaitArgs struct {
+	JID      string        `arg:"positional,required"`
+	Interval time.Duration `help:"Time between checks for new returns e.g. 30s or 5m"`
+	Timeout  time.Duration `help:"Give up on outstanding devices after this long, 0 waits until every device returns"`
+	ServerArgs
+}
+
+func (WaitArgs) Description() string {
+	return `Collect the returns of a job submitted with --async, showing which devices are still
+outstanding. Every job of the csalt run that submitted JID is waited on. Salt only sends a job to
+the devices connected when it is submitted, devices it wasn't sent to are reported as not
+responding rather than waited on.
+
+Example:
+csalt wait 20261018132328123456 --interval 5m`
+}
+
+// submitAsync submits argCommands to targets in chunks of chunkSize without waiting for returns and
+// returns the submitted job ids
+func submitAsync(targets []target, argCommands []string, chunkSize int) (*runResult, error) {
+	if chunkSize <= 0 {
+		chunkSize = len(targets)
+	}
+	result := &runResult{}
+	for _, chunk := range chunkTargets(targets, chunkSize) {
+		commands := []string{"--async", "-L", strings.Join(targetIDs(chunk), " ")}
+		output, err := getSaltBinaryOutput("salt", append(commands, argCommands...)...)
+		if err != nil {
+			return result, err
+		}
+		jid := asyncJID(output)
+		if jid == "" {
+			return result, fmt.Errorf("No job id in salt output %v", strings.TrimSpace(output))
+		}
+		result.JIDs = append(result.JIDs, jid)
+		printTargets(fmt.Sprintf("Submitted job %v to %v devices:", jid, len(chunk)), chunk)
+	}
+	fmt.Printf("Collect the returns with: csalt wait %v\n", result.JIDs[0])
+	return result, nil
+}
+
+// notSentReturn is the return of devices that salt didn't send the job to, starting like salt's
+// own no response return so they are selected by @noresponse
+var notSentReturn = json.RawMessage(`"Minion did not return. [Not sent the job, it was offline when the job was submitted]"`)
+
+// notSent returns the targets missing from the minions salt sent the jobs to, these will never
+// return so wait doesn't wait for them
+func notSent(jids []string, targets []target) []target {
+	sent := make(map[string]bool)
+	for _, jid := range jids {
+		minions, err := jobMinions(jid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing the minions of job %v, waiting for every device: %v\n", jid, err)
+			return nil
+		}
+		for _, minion := range minions {
+			sent[minion] = true
+		}
+	}
+	if len(sent) == 0 {
+		return nil
+	}
+	var missing []target
+	for _, t := range targets {
+		if !sent[t.MinionID] {
+			missing = append(missing, t)
+		}
+	}
+	printTargets(fmt.Sprintf("Salt didn't send the job to %v devices, they won't return:", len(missing)), missing)
+	return missing
+}
+
+// asyncJID returns the job id from the output of salt --async
+func asyncJID(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, asyncJIDPrefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, asyncJIDPrefix))
+		}
+	}
+	return ""
+}
+
+func runWait(argv []string) error {
+	args := WaitArgs{Interval: defaultWaitInterval}
+	parseSubcommand("wait", argv, &args)
+	server, err := configureExecutor(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	entry, err := findRunLogEntry(args.JID)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("Job %v was not run by csalt so its devices are unknown, see csalt job %v", args.JID, args.JID)
+	}
+	result, err := waitForReturns(entry, args.Interval, args.Timeout)
+	if err != nil {
+		return err
+	}
+	printRunSummary(result)
+	if stateFunctions[saltFunction(entry.Args)] {
+		printStateSummary(result)
+	}
+	if err := recordLastRun(server.Url, entry.Args, result); err != nil {
+		fmt.Printf("Error saving last run %v\n", err)
+	}
+	return runError(result)
+}
+
+// waitForReturns polls the jobs of entry until every device salt sent them to has returned or
+// timeout passes, printing each return as it arrives
+func waitForReturns(entry *runLogEntry, interval, timeout time.Duration) (*runResult, error) {
+	targets := entry.Targets()
+	returns := make(map[string]json.RawMessage)
+	printed := make(map[string]bool)
+	for _, t := range notSent(entry.JIDs, targets) {
+		returns[t.MinionID] = notSentReturn
+		printed[t.MinionID] = true
+	}
+	start := time.Now()
+	for {
+		for _, jid := range entry.JIDs {
+			jobReturns, err := lookupJob(jid)
+			if err != nil {
+				return nil, err
+			}
+			for minion, ret := range jobReturns {
+				if _, seen := returns[minion]; !seen {
+					returns[minion] = ret
+				}
+			}
+		}
+		var outstanding []target
+		result := newJobResult(targets, entry.JIDs[0], entry.Args, returns)
+		result.JIDs = entry.JIDs
+		for _, res := range result.Results {
+			if _, returned := returns[res.MinionID]; !returned {
+				outstanding = append(outstanding, res.target)
+			} else if !printed[res.MinionID] {
+				printed[res.MinionID] = true
+				printMinionResult(res)
+			}
+		}
+		if len(outstanding) == 0 || (timeout > 0 && time.Since(start) >= timeout) {
+			return result, nil
+		}
+		fmt.Printf("%v/%v devices returned, waiting %v for %v outstanding:\n", len(targets)-len(outstanding),
+			len(targets), interval, len(outstanding))
+		shown := outstanding
+		if len(shown) > maxOutstandingShown {
+			shown = shown[:maxOutstandingShown]
+		}
+		for _, t := range shown {
+			fmt.Printf("  %v (%v)\n", t.Label(), t.MinionID)
+		}
+		if len(outstanding) > len(shown) {
+			fmt.Printf("  and %v more\n", len(outstanding)-len(shown))
+		}
+		time.Sleep(interval)
+	}
+}
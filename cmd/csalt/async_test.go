@@ -0,0 +1,53 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWaitForReturnsNotSent(t *testing.T) {
+	// pi-3 was offline when the job was submitted so salt never sent it the job
+	defer useFakeExecutor(
+		fakeResponse{Command: "salt-run --out=json jobs.list_job 20261018132328123456", Stdout: `{"Minions": ["pi-1", "pi-2"]}`},
+		fakeResponse{Command: "salt-run --out=json jobs.lookup_jid 20261018132328123456", Stdout: `{"pi-1": true, "pi-2": true}`},
+	)()
+	entry := &runLogEntry{
+		Args:      []string{"test.ping"},
+		MinionIDs: []string{"pi-1", "pi-2", "pi-3"},
+		JIDs:      []string{"20261018132328123456"},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err := waitForReturns(entry, time.Millisecond, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		want := map[string]string{"pi-1": statusOK, "pi-2": statusOK, "pi-3": statusNoResponse}
+		if got := statuses(result); !reflect.DeepEqual(got, want) {
+			t.Errorf("statuses = %v, want %v", got, want)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait kept polling for a device salt didn't send the job to")
+	}
+}
@@ -0,0 +1,234 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const (
+	issueNoKey       = "no-accepted-key"
+	issueUnknownKey  = "unknown-key"
+	issueNoNodeGroup = "no-nodegroup"
+)
+
+type AuditArgs struct {
+	Output string `arg:"-o" help:"Output format: json, yaml, csv or table"`
+	ServerArgs
+}
+
+func (AuditArgs) Description() string {
+	return `Cross reference API devices with accepted salt keys and nodegroup membership.
+
+Reports API devices with no accepted key, accepted keys whose salt id matches no API device
+and API devices that are not in any nodegroup.`
+}
+
+// auditRecord is a single problem found by csalt audit
+type auditRecord struct {
+	Issue    string `json:"issue" yaml:"issue"`
+	Group    string `json:"group" yaml:"group"`
+	Device   string `json:"device" yaml:"device"`
+	SaltID   int    `json:"saltId" yaml:"saltId"`
+	MinionID string `json:"minionId" yaml:"minionId"`
+	KeyState string `json:"keyState" yaml:"keyState"`
+}
+
+// saltKeys is the json output of salt-key --list=all
+type saltKeys struct {
+	Accepted []string `json:"minions"`
+	Pending  []string `json:"minions_pre"`
+	Rejected []string `json:"minions_rejected"`
+	Denied   []string `json:"minions_denied"`
+}
+
+// States returns a map of minion id to key state
+func (keys *saltKeys) States() map[string]string {
+	states := make(map[string]string)
+	for _, id := range keys.Denied {
+		states[id] = "denied"
+	}
+	for _, id := range keys.Rejected {
+		states[id] = "rejected"
+	}
+	for _, id := range keys.Pending {
+		states[id] = "pending"
+	}
+	for _, id := range keys.Accepted {
+		states[id] = "accepted"
+	}
+	return states
+}
+
+func runAudit(argv []string) error {
+	var args AuditArgs
+	p := parseSubcommand("audit", argv, &args)
+	if err := validOutputFormat(args.Output); err != nil {
+		p.Fail(err.Error())
+	}
+	api, server, err := connect(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	records, err := auditDevices(api, server)
+	if err != nil {
+		return err
+	}
+	if args.Output != "" && args.Output != outputText {
+		return writeAuditRecords(args.Output, records)
+	}
+	printAuditRecords(records)
+	return nil
+}
+
+// listSaltKeys returns the keys known to the salt master
+func listSaltKeys() (*saltKeys, error) {
+	output, err := getSaltBinaryOutput("salt-key", "--list=all", "--out=json")
+	if err != nil {
+		return nil, err
+	}
+	keys := &saltKeys{}
+	if err := json.Unmarshal([]byte(output), keys); err != nil {
+		return nil, fmt.Errorf("Error parsing salt-key output %v", err)
+	}
+	return keys, nil
+}
+
+// auditDevices compares all API devices with salt keys and nodegroups
+func auditDevices(api *userapi.CacophonyUserAPI, server *userapi.Server) ([]auditRecord, error) {
+	devices, err := apiGroupDevices(api)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := listSaltKeys()
+	if err != nil {
+		return nil, err
+	}
+	keyStates := keys.States()
+
+	idPrefix := getSaltPrefix(server.Url, server.SaltPrefix)
+	minionIDs := make([]string, len(devices))
+	deviceIDs := make(map[string]bool, len(devices))
+	for i, device := range devices {
+		minionIDs[i] = minionID(idPrefix, device)
+		deviceIDs[minionIDs[i]] = true
+	}
+	nodesToGroup, err := readNodeGroups(server, minionIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// json output is [] rather than null when there are no issues
+	records := []auditRecord{}
+	for i, device := range devices {
+		record := auditRecord{
+			Group:    device.GroupName,
+			Device:   device.DeviceName,
+			SaltID:   device.SaltId,
+			MinionID: minionIDs[i],
+			KeyState: keyStates[minionIDs[i]],
+		}
+		if record.KeyState != "accepted" {
+			record.Issue = issueNoKey
+			records = append(records, record)
+		}
+		if _, found := nodesToGroup[minionIDs[i]]; !found {
+			record.Issue = issueNoNodeGroup
+			records = append(records, record)
+		}
+	}
+
+	// only keys named like a device of this server can be orphans
+	idPattern := regexp.MustCompile("^" + regexp.QuoteMeta(idPrefix) + "-([0-9]+)$")
+	for _, id := range keys.Accepted {
+		match := idPattern.FindStringSubmatch(id)
+		if match == nil || deviceIDs[id] {
+			continue
+		}
+		saltID, _ := strconv.Atoi(match[1])
+		records = append(records, auditRecord{
+			Issue:    issueUnknownKey,
+			SaltID:   saltID,
+			MinionID: id,
+			KeyState: "accepted",
+		})
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Issue != records[j].Issue {
+			return records[i].Issue < records[j].Issue
+		}
+		return records[i].SaltID < records[j].SaltID
+	})
+	return records, nil
+}
+
+func writeAuditRecords(format string, records []auditRecord) error {
+	rows := make([][]string, len(records))
+	for i, record := range records {
+		rows[i] = []string{
+			record.Issue,
+			record.Group,
+			record.Device,
+			strconv.Itoa(record.SaltID),
+			record.MinionID,
+			record.KeyState,
+		}
+	}
+	header := []string{"issue", "group", "device", "saltId", "minionId", "keyState"}
+	return writeRecords(os.Stdout, format, records, header, rows)
+}
+
+func printAuditRecords(records []auditRecord) {
+	sections := []struct {
+		issue string
+		title string
+	}{
+		{issueNoKey, "API devices without an accepted salt key:"},
+		{issueUnknownKey, "Accepted salt keys that match no API device:"},
+		{issueNoNodeGroup, "API devices without any node group:"},
+	}
+	for _, section := range sections {
+		count := 0
+		for _, record := range records {
+			if record.Issue != section.issue {
+				continue
+			}
+			if count == 0 {
+				fmt.Println(section.title)
+			}
+			count++
+			if record.Issue == issueUnknownKey {
+				fmt.Printf("  %v\n", record.MinionID)
+			} else if record.KeyState != "" && record.Issue == issueNoKey {
+				fmt.Printf("  %v:%v saltid: %v (key %v)\n", record.Group, record.Device, record.MinionID, record.KeyState)
+			} else {
+				fmt.Printf("  %v:%v saltid: %v\n", record.Group, record.Device, record.MinionID)
+			}
+		}
+		if count == 0 {
+			fmt.Printf("%v none\n", section.title)
+		}
+		fmt.Println()
+	}
+}
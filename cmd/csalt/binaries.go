@@ -0,0 +1,99 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	cpDescription = `Copy files to devices by friendly name with salt-cp.
+
+Example:
+csalt cp "group1:" /srv/salt/thermal-recorder.yaml /etc/cacophony/config.toml
+Copies the file to every device in group1 with salt-cp -L`
+
+	sshDescription = `Run salt-ssh on devices by friendly name, the roster must use the salt minion ids.
+
+Example:
+csalt ssh "group1:gp" test.ping`
+)
+
+type TargetedArgs struct {
+	DeviceInfo  DeviceQuery `arg:"positional,required"`
+	Commands    []string    `arg:"positional"`
+	description string      `arg:"-"`
+	ServerArgs
+}
+
+func (args TargetedArgs) Description() string {
+	return args.description
+}
+
+// targetedSubcommand returns a csalt command that translates DEVICEINFO and runs binary
+// on the resulting minion ids
+func targetedSubcommand(name, binary, description string) func(argv []string) error {
+	return func(argv []string) error {
+		args := TargetedArgs{description: description}
+		parseSubcommand(name, argv, &args)
+		if len(args.Commands) == 0 {
+			return errors.New("Commands must be specified")
+		}
+		api, server, err := connect(args.ServerArgs)
+		if err != nil {
+			return err
+		}
+		devResp, err := translateDevices(api, &args.DeviceInfo)
+		if err != nil {
+			return err
+		}
+		devices := append(devResp.Devices, devResp.NameMatches...)
+		entry := newRunLogEntry(server, binary, args.Commands)
+		entry.SetTargets(args.DeviceInfo.rawArg, newTargets(server, devices))
+		err = runBinaryForDevices(binary, server.Url, devices, args.Commands, server.SaltPrefix)
+		entry.Finish(nil, err)
+		return err
+	}
+}
+
+type PassthroughArgs struct {
+	Commands    []string `arg:"positional"`
+	description string   `arg:"-"`
+	ServerArgs
+}
+
+func (args PassthroughArgs) Description() string {
+	return args.description
+}
+
+// passthroughSubcommand returns a csalt command that runs binary with its arguments unchanged,
+// these binaries don't target minions
+func passthroughSubcommand(name, binary string) func(argv []string) error {
+	return func(argv []string) error {
+		args := PassthroughArgs{description: fmt.Sprintf(`Run %v on the salt master of the selected server.
+Arguments for %v starting with - must follow --
+
+Example:
+csalt %v --server local -- jobs.list_jobs --out=json`, binary, binary, name)}
+		parseSubcommand(name, argv, &args)
+		server, err := configureExecutor(args.ServerArgs)
+		if err != nil {
+			return err
+		}
+		return runLoggedBinary(server, binary, args.Commands...)
+	}
+}
@@ -0,0 +1,107 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// canaryTargets returns the resolved devices of the configured canary alias
+func canaryTargets(api *userapi.CacophonyUserAPI, server *userapi.Server, alias string) ([]target, error) {
+	deviceInfo, ok := server.Canaries[alias]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find canary alias %v in config", alias)
+	}
+	var query DeviceQuery
+	query.UnmarshalText([]byte(deviceInfo))
+	devResp, err := translateDevices(api, &query)
+	if err != nil {
+		return nil, err
+	}
+	return newTargets(server, append(devResp.Devices, devResp.NameMatches...)), nil
+}
+
+// chooseCanaries splits targets into count canaries and the rest. Canaries are taken from
+// preferred targets first and then at random, a count of 0 takes every preferred target
+func chooseCanaries(targets, preferred []target, count int) ([]target, []target) {
+	isPreferred := make(map[string]bool, len(preferred))
+	for _, t := range preferred {
+		isPreferred[t.MinionID] = true
+	}
+	var candidates, others []target
+	for _, t := range targets {
+		if isPreferred[t.MinionID] {
+			candidates = append(candidates, t)
+		} else {
+			others = append(others, t)
+		}
+	}
+	if count == 0 {
+		return candidates, others
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random.Shuffle(len(others), func(i, j int) {
+		others[i], others[j] = others[j], others[i]
+	})
+	candidates = append(candidates, others...)
+	if count > len(candidates) {
+		count = len(candidates)
+	}
+	canaries := candidates[:count]
+	chosen := make(map[string]bool, count)
+	for _, t := range canaries {
+		chosen[t.MinionID] = true
+	}
+	var rest []target
+	for _, t := range targets {
+		if !chosen[t.MinionID] {
+			rest = append(rest, t)
+		}
+	}
+	return canaries, rest
+}
+
+// runCanaries runs argCommands on the canaries and returns an error unless they all succeed and
+// the user agrees to continue with the remaining devices
+func runCanaries(canaries, rest []target, argCommands []string, yes bool, p perDevice) (*runResult, error) {
+	if len(canaries) == 0 {
+		return nil, errors.New("No canary devices found")
+	}
+	fmt.Printf("Running on %v canary devices\n", len(canaries))
+	progress := startProgress(canaries, true, true)
+	result, err := collectTargets(canaries, argCommands, progress.Result, p)
+	progress.Stop()
+	if err != nil {
+		return nil, err
+	}
+	printRunSummary(result)
+	if failures := result.Failures(); failures > 0 {
+		return result, fmt.Errorf("%v canary devices failed or did not respond, not running on the remaining %v devices",
+			failures, len(rest))
+	}
+	if len(rest) == 0 {
+		return result, nil
+	}
+	if !yes && !confirm(fmt.Sprintf("Canaries succeeded, run on the remaining %v devices?", len(rest))) {
+		return result, fmt.Errorf("Not run on the remaining %v devices", len(rest))
+	}
+	return result, nil
+}
@@ -0,0 +1,288 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const (
+	executorSudo   = "sudo"
+	executorDirect = "direct"
+	executorSSH    = "ssh"
+	executorFake   = "fake"
+
+	// remoteNotExist is the exit status used by the ssh executor when a file is missing
+	remoteNotExist = 66
+)
+
+// saltExec runs every salt command, it is chosen from the server config by connect
+var saltExec saltExecutor = sudoExecutor{}
+
+// saltCmd is a salt binary and its arguments along with the stdio to attach
+type saltCmd struct {
+	binary string
+	args   []string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (cmd *saltCmd) String() string {
+	return strings.Join(append([]string{cmd.binary}, cmd.args...), " ")
+}
+
+// saltExecutor runs salt commands and reads files on the salt master
+type saltExecutor interface {
+	Run(cmd *saltCmd) error
+	ReadFile(file string) ([]byte, error)
+	Glob(pattern string) ([]string, error)
+}
+
+// concurrentExecutor is implemented by executors that can run several salt commands at once,
+// prepareConcurrent asks for any credentials first so the commands don't prompt together
+type concurrentExecutor interface {
+	prepareConcurrent() error
+}
+
+// executorID identifies the salt master the executor of server runs salt on
+func executorID(server *userapi.Server) string {
+	conf := server.Executor
+	if conf == nil || conf.Type == "" {
+		return executorSudo
+	}
+	switch conf.Type {
+	case executorSSH:
+		return executorSSH + " " + conf.Host
+	case executorFake:
+		return executorFake + " " + conf.Script
+	case executorSaltAPI:
+		if server.SaltAPI != nil {
+			return executorSaltAPI + " " + server.SaltAPI.Url
+		}
+	}
+	return conf.Type
+}
+
+// newExecutor returns the executor configured for server, sudo is used if none is configured
+func newExecutor(server *userapi.Server) (saltExecutor, error) {
+	conf := server.Executor
+	if conf == nil {
+		return sudoExecutor{}, nil
+	}
+	switch conf.Type {
+	case "", executorSudo:
+		return sudoExecutor{}, nil
+	case executorDirect:
+		return directExecutor{}, nil
+	case executorSSH:
+		if conf.Host == "" {
+			return nil, fmt.Errorf("ssh executor requires a host")
+		}
+		return &sshExecutor{host: conf.Host, sudo: conf.Sudo}, nil
+	case executorFake:
+		return newFakeExecutor(conf.Script)
+	case executorSaltAPI:
+		return newSaltAPIExecutor(server.SaltAPI)
+	}
+	return nil, fmt.Errorf("Unknown executor type %v", conf.Type)
+}
+
+// localFiles reads salt master files from the local file system
+type localFiles struct{}
+
+func (localFiles) ReadFile(file string) ([]byte, error) {
+	return ioutil.ReadFile(file)
+}
+
+func (localFiles) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func runCommand(name string, cmd *saltCmd, args ...string) error {
+	if debug {
+		fmt.Fprintf(os.Stderr, "%v %v\n", name, strings.Join(args, " "))
+	}
+	execCmd := exec.Command(name, args...)
+	execCmd.Stdin = cmd.stdin
+	execCmd.Stdout = cmd.stdout
+	execCmd.Stderr = cmd.stderr
+	return execCmd.Run()
+}
+
+// directExecutor runs salt as the current user, for when csalt is run as root on the master
+type directExecutor struct {
+	localFiles
+}
+
+func (directExecutor) Run(cmd *saltCmd) error {
+	return runCommand(cmd.binary, cmd, cmd.args...)
+}
+
+func (directExecutor) prepareConcurrent() error {
+	return nil
+}
+
+// sudoExecutor runs salt with sudo on the local salt master
+type sudoExecutor struct {
+	localFiles
+}
+
+func (sudoExecutor) Run(cmd *saltCmd) error {
+	return runCommand("sudo", cmd, append([]string{cmd.binary}, cmd.args...)...)
+}
+
+// prepareConcurrent validates the sudo credentials so later commands use the cached credentials
+func (sudoExecutor) prepareConcurrent() error {
+	return runCommand("sudo", &saltCmd{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, "-v")
+}
+
+// sshExecutor runs salt on a remote salt master over ssh
+type sshExecutor struct {
+	host string
+	sudo bool
+}
+
+// shellQuote quotes arg for the remote shell
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'"'"'`, -1) + "'"
+}
+
+func (e *sshExecutor) remote(args ...string) string {
+	quoted := make([]string, 0, len(args)+1)
+	if e.sudo {
+		quoted = append(quoted, "sudo")
+	}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (e *sshExecutor) Run(cmd *saltCmd) error {
+	return runCommand("ssh", cmd, e.host, e.remote(append([]string{cmd.binary}, cmd.args...)...))
+}
+
+func (e *sshExecutor) ReadFile(file string) ([]byte, error) {
+	var stdout bytes.Buffer
+	script := fmt.Sprintf("test -e %v || exit %v; cat %v", shellQuote(file), remoteNotExist, shellQuote(file))
+	err := e.Run(&saltCmd{binary: "sh", args: []string{"-c", script}, stdout: &stdout, stderr: os.Stderr})
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == remoteNotExist {
+		return nil, &os.PathError{Op: "open", Path: file, Err: os.ErrNotExist}
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %v on %v: %v", file, e.host, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (e *sshExecutor) Glob(pattern string) ([]string, error) {
+	var stdout bytes.Buffer
+	// the pattern is left unquoted so the remote shell expands it
+	script := fmt.Sprintf("cd %v && for f in %v; do test -e \"$f\" && echo \"$f\"; done; true",
+		shellQuote(path.Dir(pattern)), path.Base(pattern))
+	err := e.Run(&saltCmd{binary: "sh", args: []string{"-c", script}, stdout: &stdout, stderr: os.Stderr})
+	if err != nil {
+		return nil, fmt.Errorf("listing %v on %v: %v", pattern, e.host, err)
+	}
+	var matches []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line != "" {
+			matches = append(matches, path.Join(path.Dir(pattern), line))
+		}
+	}
+	return matches, nil
+}
+
+// fakeResponse is a scripted reply to commands matching Command, a glob of the command line
+type fakeResponse struct {
+	Command string `yaml:"command"`
+	Stdout  string `yaml:"stdout"`
+	Stderr  string `yaml:"stderr"`
+	Exit    int    `yaml:"exit"`
+}
+
+// fakeExecutor replies to salt commands from a script so csalt can be tried without a salt master
+type fakeExecutor struct {
+	localFiles
+	responses []fakeResponse
+}
+
+func newFakeExecutor(script string) (*fakeExecutor, error) {
+	if script == "" {
+		return nil, fmt.Errorf("fake executor requires a script")
+	}
+	buf, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, err
+	}
+	e := &fakeExecutor{}
+	if err := yaml.Unmarshal(buf, &e.responses); err != nil {
+		return nil, fmt.Errorf("Error parsing fake executor script %v: %v", script, err)
+	}
+	return e, nil
+}
+
+// fakeMatch reports whether line matches pattern where * matches any text, including /
+func fakeMatch(pattern, line string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	matched, _ := regexp.MatchString("^"+expr+"$", line)
+	return matched
+}
+
+func (e *fakeExecutor) prepareConcurrent() error {
+	return nil
+}
+
+func (e *fakeExecutor) Run(cmd *saltCmd) error {
+	line := cmd.String()
+	if debug {
+		fmt.Fprintf(os.Stderr, "fake %v\n", line)
+	}
+	for _, response := range e.responses {
+		if !fakeMatch(response.Command, line) {
+			continue
+		}
+		if cmd.stdin != nil && cmd.stdin != os.Stdin {
+			io.Copy(ioutil.Discard, cmd.stdin)
+		}
+		if cmd.stdout != nil {
+			io.WriteString(cmd.stdout, response.Stdout)
+		}
+		if cmd.stderr != nil {
+			io.WriteString(cmd.stderr, response.Stderr)
+		}
+		if response.Exit != 0 {
+			return fmt.Errorf("%v: exit status %v", cmd.binary, response.Exit)
+		}
+		return nil
+	}
+	return fmt.Errorf("fake executor has no response for %v", line)
+}
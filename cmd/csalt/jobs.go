@@ -0,0 +1,167 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultJobsLimit = 20
+
+type JobsArgs struct {
+	Group  string `help:"Only list jobs run on devices in this group"`
+	Limit  int    `arg:"-n" help:"Number of jobs to list, 0 for all"`
+	Output string `arg:"-o" help:"Output format: json, yaml, csv or table"`
+	ServerArgs
+}
+
+func (JobsArgs) Description() string {
+	return `List the salt jobs run by csalt on the selected server, newest last.
+
+Jobs are read from the csalt audit log in ~/.csalt/audit.log, see csalt job JID for the results.
+
+Example:
+csalt jobs --group group2 -n 50`
+}
+
+type JobArgs struct {
+	JID string `arg:"positional,required"`
+	ServerArgs
+}
+
+func (JobArgs) Description() string {
+	return `Show the results of a salt job from the salt master job cache labelled with friendly device
+names, using salt-run jobs.lookup_jid.`
+}
+
+func runJobs(argv []string) error {
+	args := JobsArgs{Limit: defaultJobsLimit}
+	p := parseSubcommand("jobs", argv, &args)
+	if err := validOutputFormat(args.Output); err != nil {
+		p.Fail(err.Error())
+	}
+	server, err := configureExecutor(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	entries, err := readRunLog()
+	if err != nil {
+		return err
+	}
+	// json output is [] rather than null when there are no jobs
+	jobs := []runLogEntry{}
+	for _, entry := range entries {
+		if len(entry.JIDs) > 0 && entry.Server == server.Url && entry.inGroup(args.Group) {
+			jobs = append(jobs, entry)
+		}
+	}
+	if args.Limit > 0 && len(jobs) > args.Limit {
+		jobs = jobs[len(jobs)-args.Limit:]
+	}
+	format := args.Output
+	if format == "" || format == outputText {
+		format = outputTable
+	}
+	return writeJobRecords(format, jobs)
+}
+
+// inGroup returns true if the entry ran on a device in group, or group is empty
+func (e *runLogEntry) inGroup(group string) bool {
+	if group == "" {
+		return true
+	}
+	for _, t := range e.Targets() {
+		if t.Device.GroupName == group {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJobRecords(format string, jobs []runLogEntry) error {
+	rows := make([][]string, len(jobs))
+	for i, job := range jobs {
+		rows[i] = []string{
+			job.Time,
+			strings.Join(job.JIDs, ";"),
+			job.APIUser,
+			job.DeviceInfo,
+			strconv.Itoa(len(job.MinionIDs)),
+			strings.Join(job.Args, " "),
+			strconv.Itoa(job.Exit),
+		}
+	}
+	header := []string{"time", "jids", "user", "deviceInfo", "devices", "args", "exit"}
+	return writeRecords(os.Stdout, format, jobs, header, rows)
+}
+
+// findRunLogEntry returns the run log entry of the job jid, or nil if csalt didn't run it
+func findRunLogEntry(jid string) (*runLogEntry, error) {
+	entries, err := readRunLog()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		for _, entryJID := range entries[i].JIDs {
+			if entryJID == jid {
+				return &entries[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func runJob(argv []string) error {
+	var args JobArgs
+	parseSubcommand("job", argv, &args)
+	if _, err := configureExecutor(args.ServerArgs); err != nil {
+		return err
+	}
+	entry, err := findRunLogEntry(args.JID)
+	if err != nil {
+		return err
+	}
+	returns, err := lookupJob(args.JID)
+	if err != nil {
+		return err
+	}
+
+	var targets []target
+	var argCommands []string
+	if entry != nil {
+		fmt.Printf("Job %v run by %v (%v) at %v on %v: %v %v\n", args.JID, entry.LocalUser, entry.APIUser,
+			entry.Time, entry.DeviceInfo, entry.Binary, strings.Join(entry.Args, " "))
+		targets = entry.Targets()
+		argCommands = entry.Args
+	} else {
+		fmt.Printf("Job %v was not run by csalt, showing minion ids\n", args.JID)
+		for _, id := range sortedKeys(returns) {
+			targets = append(targets, target{MinionID: id})
+		}
+	}
+	result := newJobResult(targets, args.JID, argCommands, returns)
+	for _, res := range result.Results {
+		printMinionResult(res)
+	}
+	printRunSummary(result)
+	if stateFunctions[saltFunction(argCommands)] {
+		printStateSummary(result)
+	}
+	return nil
+}
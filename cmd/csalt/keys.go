@@ -0,0 +1,124 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// keyActions maps csalt key actions to the salt-key option performing them
+var keyActions = map[string]string{
+	"accept": "--accept",
+	"reject": "--reject",
+	"delete": "--delete",
+	"list":   "",
+}
+
+type KeyArgs struct {
+	Action     string      `arg:"positional,required" help:"accept, reject, delete or list"`
+	DeviceInfo DeviceQuery `arg:"positional,required"`
+	Yes        bool        `arg:"-y" help:"Change keys without asking for confirmation"`
+	ServerArgs
+}
+
+func (KeyArgs) Description() string {
+	return `Manage the salt keys of devices by friendly name.
+
+Examples:
+csalt key list "group1:"
+Shows the salt key state of every device in group1
+
+csalt key delete "group1:gp"
+Deletes the salt key of device gp in group1`
+}
+
+func runKey(argv []string) error {
+	var args KeyArgs
+	p := parseSubcommand("key", argv, &args)
+	option, ok := keyActions[args.Action]
+	if !ok {
+		p.Fail(fmt.Sprintf("unknown key action %v", args.Action))
+	}
+	api, server, err := connect(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	devResp, err := translateDevices(api, &args.DeviceInfo)
+	if err != nil {
+		return err
+	}
+	devices := append(devResp.Devices, devResp.NameMatches...)
+	if len(devices) == 0 {
+		return errors.New("No valid devices found")
+	}
+	ids := saltDeviceCommand(server.Url, devices, server.SaltPrefix)
+
+	if args.Action == "list" {
+		return listDeviceKeys(devices, ids)
+	}
+
+	fmt.Printf("Keys to %v:\n", args.Action)
+	for i, device := range devices {
+		fmt.Printf("  %v %v\n", deviceLabel(device), ids[i])
+	}
+	if !args.Yes && !confirm(fmt.Sprintf("%v %v keys?", args.Action, len(ids))) {
+		return errors.New("No keys changed")
+	}
+	entry := newRunLogEntry(server, "salt-key", []string{"--yes", option})
+	entry.SetTargets(args.DeviceInfo.rawArg, newTargets(server, devices))
+	err = changeDeviceKeys(option, devices, ids)
+	entry.Finish(nil, err)
+	return err
+}
+
+// listDeviceKeys prints the salt key state of each device
+func listDeviceKeys(devices []userapi.Device, ids []string) error {
+	keys, err := listSaltKeys()
+	if err != nil {
+		return err
+	}
+	states := keys.States()
+	for i, device := range devices {
+		state, ok := states[ids[i]]
+		if !ok {
+			state = "missing"
+		}
+		fmt.Printf("%v %v %v\n", deviceLabel(device), ids[i], state)
+	}
+	return nil
+}
+
+// changeDeviceKeys runs salt-key with option on each minion id, salt-key only accepts a
+// single glob so each key is changed separately
+func changeDeviceKeys(option string, devices []userapi.Device, ids []string) error {
+	failed := 0
+	for i, device := range devices {
+		output, err := getSaltBinaryOutput("salt-key", "--yes", option+"="+ids[i])
+		fmt.Printf("%v %v: %v\n", deviceLabel(device), ids[i], strings.TrimSpace(output))
+		if err != nil {
+			fmt.Printf("%v %v: salt-key failed %v\n", deviceLabel(device), ids[i], err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Failed to change %v keys", failed)
+	}
+	return nil
+}
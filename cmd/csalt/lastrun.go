@@ -0,0 +1,96 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const lastRunFile = "last-run.yaml"
+
+// lastRunTokens maps the DEVICEINFO @tokens to the run status they select
+var lastRunTokens = map[string]string{
+	"failed":     statusFailed,
+	"noresponse": statusNoResponse,
+}
+
+// lastRun is the outcome of the most recent run on a server
+type lastRun struct {
+	Time    string   `yaml:"time"`
+	Command []string `yaml:"command,omitempty"`
+	JIDs    []string `yaml:"jids,omitempty"`
+	// Devices are the devices that didn't succeed by their status
+	Devices map[string][]userapi.Device `yaml:"devices"`
+}
+
+// recordLastRun saves the devices that failed or didn't respond in result as the last run of
+// argCommands on serverURL
+func recordLastRun(serverURL string, argCommands []string, result *runResult) error {
+	run := &lastRun{
+		Time:    time.Now().Format(time.RFC3339),
+		Command: argCommands,
+		JIDs:    result.JIDs,
+		Devices: make(map[string][]userapi.Device),
+	}
+	for _, status := range lastRunTokens {
+		for _, t := range result.Targets(status) {
+			run.Devices[status] = append(run.Devices[status], t.Device)
+		}
+	}
+	runs := make(map[string]*lastRun)
+	return updateStateFile(lastRunFile, &runs, func() error {
+		runs[serverURL] = run
+		return nil
+	})
+}
+
+// lastRunDevices returns the devices of the last run on serverURL selected by tokens
+func lastRunDevices(serverURL string, tokens []string) ([]userapi.Device, error) {
+	runs := make(map[string]*lastRun)
+	if err := readStateFile(lastRunFile, &runs); err != nil {
+		return nil, err
+	}
+	run, ok := runs[serverURL]
+	if !ok {
+		return nil, fmt.Errorf("No previous run recorded for %v", serverURL)
+	}
+	var devices []userapi.Device
+	for _, token := range tokens {
+		status, ok := lastRunTokens[token]
+		if !ok {
+			return nil, fmt.Errorf("Unknown device token @%v, expected @failed or @noresponse", token)
+		}
+		devices = append(devices, run.Devices[status]...)
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("No devices matched @%v in the last run at %v", strings.Join(tokens, ",@"), run.describe())
+	}
+	fmt.Fprintf(os.Stderr, "Using @%v from the last run at %v\n", strings.Join(tokens, ",@"), run.describe())
+	return devices, nil
+}
+
+// describe names the run by its time and command
+func (run *lastRun) describe() string {
+	if len(run.Command) == 0 {
+		return run.Time
+	}
+	return fmt.Sprintf("%v: %v", run.Time, strings.Join(run.Command, " "))
+}
@@ -0,0 +1,72 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordLastRunConcurrent(t *testing.T) {
+	defer useTempState(t)()
+	targets := testTargets(1)
+	result := &runResult{Results: []minionResult{{target: targets[0], Status: statusFailed}}}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			errs <- recordLastRun(server, []string{"test.ping"}, result)
+		}("server" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every server's run is kept when runs are recorded at the same time
+	for i := 0; i < 10; i++ {
+		devices, err := lastRunDevices("server"+strconv.Itoa(i), []string{"failed"})
+		if err != nil {
+			t.Error(err)
+		} else if len(devices) != 1 || devices[0].DeviceName != "cam1" {
+			t.Errorf("server%v failed devices = %v", i, devices)
+		}
+	}
+}
+
+func TestRecordLastRunReplaces(t *testing.T) {
+	defer useTempState(t)()
+	targets := testTargets(2)
+	failed := &runResult{Results: []minionResult{{target: targets[0], Status: statusFailed}}}
+	if err := recordLastRun("server", []string{"state.apply"}, failed); err != nil {
+		t.Fatal(err)
+	}
+	succeeded := &runResult{Results: []minionResult{{target: targets[1], Status: statusOK}}}
+	if err := recordLastRun("server", []string{"test.ping"}, succeeded); err != nil {
+		t.Fatal(err)
+	}
+	// the failed device of the earlier run is no longer selected
+	_, err := lastRunDevices("server", []string{"failed"})
+	if err == nil || !strings.Contains(err.Error(), "test.ping") {
+		t.Errorf("lastRunDevices = %v, want no devices from the test.ping run", err)
+	}
+}
@@ -16,17 +16,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"reflect"
 	"strconv"
 	"strings"
 
 	"github.com/howeyc/gopass"
-	"gopkg.in/yaml.v1"
 
 	"github.com/TheCacophonyProject/csalt/userapi"
 	"github.com/alexflint/go-arg"
@@ -35,7 +34,6 @@ import (
 const (
 	maxPasswordAttempts = 3
 	testPrefix          = "test"
-	nodeGroupFile       = "/etc/salt/master.d/nodegroups.conf"
 )
 
 var debug = false
@@ -43,6 +41,7 @@ var debug = false
 type DeviceQuery struct {
 	devices []userapi.Device
 	groups  []string
+	lastRun []string
 	rawArg  string
 }
 
@@ -51,20 +50,23 @@ func (devQ *DeviceQuery) RawQuery() bool {
 }
 
 func (devQ *DeviceQuery) HasValues() bool {
-	return len(devQ.devices) > 0 || len(devQ.groups) > 0
+	return len(devQ.devices) > 0 || len(devQ.groups) > 0 || len(devQ.lastRun) > 0
 }
 
 // UnmarshalText is called automatically by go-arg when an argument of type DeviceQuery is being parsed.
 // parses supplied bytes into devices and groups by splitting supplied bytes by spaces.
 // Devices must be in the format groupname:devicename
 // Groups must be in the format groupname(: optional)
+// @failed and @noresponse select devices from the last run
 func (devQ *DeviceQuery) UnmarshalText(b []byte) error {
 	devQ.rawArg = string(b)
 	devices := strings.Split(strings.TrimSpace(string(b)), ",")
 
 	for _, devInfo := range devices {
 		pos := strings.Index(devInfo, ":")
-		if pos == 0 {
+		if strings.HasPrefix(devInfo, "@") {
+			devQ.lastRun = append(devQ.lastRun, devInfo[1:])
+		} else if pos == 0 {
 			devQ.devices = append(devQ.devices, userapi.Device{
 				DeviceName: devInfo[1:]})
 		} else if pos >= 0 {
@@ -88,6 +90,10 @@ func (Args) Description() string {
 1. Device and Groups. A list of Devices or group names to translate separated by a comma
 	- Devices can be in the format of groupname:devicename, or devicename (which will match any group)
 	- Groups will be translated into all devices in this group groupname:
+2. @failed and @noresponse. The devices that failed or did not respond in the last run on the server
+
+A DEVICEINFO that is exactly the name of a command below runs the command, so a group or device
+named e.g. key, run or shell must be written as key: for the group or :key for the device.
 
 If only 1 parameter is supplied this will run directly on salt
 
@@ -98,36 +104,133 @@ csalt "gp" test.ping
 Will find all devices named gp of any group and run test.ping
 
 csalt "group1:,group2:gp" test.ping
-Will run test.ping on all devices in group1 and on device gp in group2.`
+Will run test.ping on all devices in group1 and on device gp in group2.
+
+Commands (see csalt COMMAND --help):
+csalt nodegroups sync
+Write a salt nodegroup for every API group
+
+csalt audit
+Report devices without salt keys or nodegroups and salt keys without devices
+
+csalt key accept|reject|delete|list DEVICEINFO
+Manage the salt keys of devices by friendly name
+
+csalt cp DEVICEINFO SOURCE DEST
+csalt ssh DEVICEINFO COMMANDS
+Run salt-cp or salt-ssh on devices by friendly name
+
+csalt run COMMANDS
+csalt call COMMANDS
+Run salt-run or salt-call directly
+
+csalt jobs
+csalt job JID
+List past csalt jobs and show a job's results by friendly name
+
+csalt wait JID
+Collect the returns of a job submitted with --async
+
+csalt plan DEVICEINFO [STATES]
+Preview the changes state.apply would make across the devices
+
+csalt watch DEVICEINFO COMMANDS
+Repeatedly run a command and show which devices' returns change
+
+csalt shell DEVICEINFO
+Open a prompt that runs salt commands on the devices`
 }
 
 type Args struct {
-	DeviceInfo DeviceQuery `arg:"positional"`
-	Commands   []string    `arg:"positional"`
-	Show       bool        `arg:"-s" help:"Print salt ids for device names"`
-	Server     string      `help:"--server to use, this should be defined in cacophony-user.yaml"`
-	TestServer bool        `arg:"--test" help:"Connect to the test api server"`
-	ProdServer bool        `arg:"--prod" help:"Connect to the prod api server"`
-	TestPrefix bool        `arg:"-t" help:"Add -test to salt names e.g. pi-test-xxx"`
-	NoPrefix     bool      `arg:"--no-prefix" help:"Dont add a prefix even if test"`
-	User       string      `arg:"--user" help:"Username to authenticate with server"`
-	Debug      bool        `arg:"-d" help:"debug"`
-	Verbose    bool        `arg:"-v" help:"verbose"`
+	DeviceInfo  DeviceQuery `arg:"positional"`
+	Commands    []string    `arg:"positional"`
+	Show        bool        `arg:"-s" help:"Print salt ids for device names"`
+	Output      string      `arg:"-o" help:"Format for --show output: json, yaml, csv or table"`
+	ChunkSize   int         `arg:"--chunk-size" help:"Run salt on at most this many devices at a time"`
+	Batch       BatchSize   `help:"Run salt on batches of this many devices or percent of devices e.g. 10 or 10%"`
+	MaxFailures int         `arg:"--max-failures" help:"Stop running batches once more than this many devices fail, -1 for no limit"`
+	Canary      int         `help:"Run on this many randomly chosen devices first and check they succeed"`
+	CanaryAlias string      `arg:"--canary-alias" help:"Run on the devices of this canaries alias from cacophony-user.yaml first"`
+	Yes         bool        `arg:"-y" help:"Continue after the canaries succeed without asking"`
+	Preflight   bool        `help:"Ping the devices first and only run on those that respond"`
+	Async       bool        `help:"Submit the job and exit without waiting for returns, see csalt wait"`
+	Progress    bool        `help:"Show the returned and failed counts and outstanding devices while salt runs"`
+	Parallel    int         `help:"Number of salt commands to run at once when COMMANDS use {group}, {device} or {saltid}"`
+	Pillar      bool        `help:"Pass each device's API metadata to states as pillar cacophony, running salt per device"`
+	ServerArgs
+}
+
+// perDevice returns when salt is run separately for each device
+func (args Args) perDevice() perDevice {
+	return perDevice{parallel: args.Parallel, pillar: args.Pillar}
+}
+
+// ServerArgs selects the api server and salt naming, they are shared by every csalt command
+type ServerArgs struct {
+	Server     string `help:"--server to use, this should be defined in cacophony-user.yaml"`
+	TestServer bool   `arg:"--test" help:"Connect to the test api server"`
+	ProdServer bool   `arg:"--prod" help:"Connect to the prod api server"`
+	TestPrefix bool   `arg:"-t" help:"Add -test to salt names e.g. pi-test-xxx"`
+	NoPrefix   bool   `arg:"--no-prefix" help:"Dont add a prefix even if test"`
+	User       string `arg:"--user" help:"Username to authenticate with server"`
+	Debug      bool   `arg:"-d" help:"debug"`
+	Verbose    bool   `arg:"-v" help:"verbose"`
+}
+
+// subcommands maps the first argument to the csalt command it runs, anything else is
+// treated as DEVICEINFO
+var subcommands = map[string]func(args []string) error{
+	"nodegroups": runNodeGroups,
+	"audit":      runAudit,
+	"key":        runKey,
+	"cp":         targetedSubcommand("cp", "salt-cp", cpDescription),
+	"ssh":        targetedSubcommand("ssh", "salt-ssh", sshDescription),
+	"run":        passthroughSubcommand("run", "salt-run"),
+	"call":       passthroughSubcommand("call", "salt-call"),
+	"jobs":       runJobs,
+	"job":        runJob,
+	"wait":       runWait,
+	"plan":       runPlan,
+	"watch":      runWatch,
+	"shell":      runShell,
+}
+
+// parseSubcommand parses args into dest for the csalt subcommand name, printing help or usage
+// and exiting as go-arg does for the main arguments
+func parseSubcommand(name string, args []string, dest interface{}) *arg.Parser {
+	p, err := arg.NewParser(arg.Config{Program: "csalt " + name}, dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = p.Parse(args)
+	if err == arg.ErrHelp {
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	} else if err != nil {
+		p.Fail(err.Error())
+	}
+	return p
 }
 
 func procArgs() Args {
-	var args Args
-	arg.MustParse(&args)
+	args := Args{ChunkSize: defaultChunkSize, MaxFailures: -1, Parallel: defaultParallel}
+	p := arg.MustParse(&args)
+	if err := validOutputFormat(args.Output); err != nil {
+		p.Fail(err.Error())
+	}
+	if err := args.perDevice().check(args.Commands); err != nil {
+		p.Fail(err.Error())
+	}
 	if args.Verbose {
 		for _, device := range args.DeviceInfo.devices {
 			if device.GroupName == "" {
-				fmt.Printf("Looking for device by name %v\n", device.DeviceName)
+				fmt.Fprintf(os.Stderr, "Looking for device by name %v\n", device.DeviceName)
 			} else {
-				fmt.Printf("Looking for group:device %v:%v\n", device.GroupName, device.DeviceName)
+				fmt.Fprintf(os.Stderr, "Looking for group:device %v:%v\n", device.GroupName, device.DeviceName)
 			}
 		}
 		for _, group := range args.DeviceInfo.groups {
-			fmt.Printf("Looking for devices in group %v\n", group)
+			fmt.Fprintf(os.Stderr, "Looking for devices in group %v\n", group)
 
 		}
 	}
@@ -135,12 +238,63 @@ func procArgs() Args {
 }
 
 func main() {
-	err := runMain()
+	var err error
+	if run, argv, ok := subcommandFor(os.Args); ok {
+		err = run(argv)
+	} else {
+		err = runMain()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// subcommandFor returns the subcommand named by the first argument that isn't a flag or the value
+// of a flag, and the arguments for it including any flags given before the subcommand name
+func subcommandFor(args []string) (func(args []string) error, []string, bool) {
+	flags := make(map[string]bool)
+	valueFlags(reflect.TypeOf(Args{}), flags)
+	for i := 1; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+		if strings.HasPrefix(args[i], "-") {
+			if flags[args[i]] {
+				i++
+			}
+			continue
+		}
+		run, ok := subcommands[args[i]]
+		if !ok {
+			break
+		}
+		argv := append(append([]string{}, args[1:i]...), args[i+1:]...)
+		return run, argv, true
+	}
+	return nil, nil, false
+}
+
+// valueFlags adds the flags of the args struct t that are followed by a value to flags
+func valueFlags(t reflect.Type, flags map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			valueFlags(field.Type, flags)
+			continue
+		}
+		tag := field.Tag.Get("arg")
+		if field.Type.Kind() == reflect.Bool || strings.Contains(tag, "positional") {
+			continue
+		}
+		flags["--"+strings.ToLower(field.Name)] = true
+		for _, key := range strings.Split(tag, ",") {
+			if strings.HasPrefix(key, "-") {
+				flags[key] = true
+			}
+		}
+	}
+}
+
 // authenticateUser checks user authentication and requests user password if required
 // once authenticated requests and saves a temporary access token
 func authenticateUser(api *userapi.CacophonyUserAPI) error {
@@ -202,13 +356,28 @@ func saltDeviceCommand(serverURL string, devices []userapi.Device, saltPrefix st
 	idPrefix := getSaltPrefix(serverURL, saltPrefix)
 	fullDevice := make([]string, len(devices))
 	for i := 0; i < len(devices); i++ {
-		fullDevice[i] = idPrefix + "-" + strconv.Itoa(devices[i].SaltId)
+		fullDevice[i] = minionID(idPrefix, devices[i])
 	}
 	return fullDevice
 }
 
+// deviceLabel returns the friendly groupname:devicename of device
+func deviceLabel(device userapi.Device) string {
+	return device.GroupName + ":" + device.DeviceName
+}
+
+// minionID returns the salt minion id of device for the supplied id prefix e.g. pi-test
+func minionID(idPrefix string, device userapi.Device) string {
+	return idPrefix + "-" + strconv.Itoa(device.SaltId)
+}
+
 // runSaltForDevices executes salt on supplied devices with argCommands
 func runSaltForDevices(serverURL string, devices []userapi.Device, argCommands []string, saltPrefix string) error {
+	return runBinaryForDevices("salt", serverURL, devices, argCommands, saltPrefix)
+}
+
+// runBinaryForDevices executes the salt binary e.g. salt-cp on supplied devices with argCommands
+func runBinaryForDevices(binary, serverURL string, devices []userapi.Device, argCommands []string, saltPrefix string) error {
 	if len(devices) == 0 {
 		return errors.New("No valid devices found")
 	}
@@ -219,41 +388,55 @@ func runSaltForDevices(serverURL string, devices []userapi.Device, argCommands [
 	}
 	commands = append(commands, ids)
 	commands = append(commands, argCommands...)
-	return runSalt(commands...)
+	return runSaltBinary(binary, commands...)
 }
 
 // getSaltOutput with sudo on supplied arguments
 func getSaltOutput(commands ...string) (string, error) {
-	commands = append([]string{"salt"}, commands...)
-	if debug {
-		fmt.Printf("sudo %v\n", strings.Join(commands, " "))
-	}
-	output, err := exec.Command("sudo", commands...).Output()
+	return getSaltBinaryOutput("salt", commands...)
+}
+
+// getSaltBinaryOutput runs the salt binary e.g. salt-key on supplied arguments
+func getSaltBinaryOutput(binary string, commands ...string) (string, error) {
+	var stdout bytes.Buffer
+	err := saltExec.Run(&saltCmd{binary: binary, args: commands, stdout: &stdout})
 	if err != nil {
 		return "", err
 	}
-	return string(output), nil
+	return stdout.String(), nil
 }
 
-// runSalt with sudo on supplied arguments
+// runSalt on supplied arguments
 func runSalt(commands ...string) error {
+	return runSaltBinary("salt", commands...)
+}
 
-	commands = append([]string{"salt"}, commands...)
-	if debug {
-		fmt.Printf("sudo %v\n", strings.Join(commands, " "))
-	}
-	cmd := exec.Command("sudo", commands...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	err := cmd.Run()
+// runLoggedBinary runs the salt binary with supplied arguments on server and records it in the run log
+func runLoggedBinary(server *userapi.Server, binary string, commands ...string) error {
+	entry := newRunLogEntry(server, binary, commands)
+	err := runSaltBinary(binary, commands...)
+	entry.Finish(nil, err)
 	return err
 }
 
-func apiFromArgs(args Args) (*userapi.CacophonyUserAPI, string, error) {
+// runSaltBinary runs the salt binary e.g. salt-run on supplied arguments
+func runSaltBinary(binary string, commands ...string) error {
+	return saltExec.Run(&saltCmd{
+		binary: binary,
+		args:   commands,
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	})
+}
+
+// serverFromArgs resolves the settings of the server selected by args from the user config.
+// The user name is empty if it should come from the top level of the config
+func serverFromArgs(args ServerArgs) (*userapi.Config, *userapi.Server, error) {
 	config, _ := userapi.NewConfig()
 	serverURL := config.ServerURL
 	var saltPrefix, username string
+	settings := &userapi.Server{}
 	if args.ProdServer {
 		serverURL = fmt.Sprintf("https://%v", userapi.ProdAPIHost)
 	} else if args.TestServer {
@@ -261,11 +444,12 @@ func apiFromArgs(args Args) (*userapi.CacophonyUserAPI, string, error) {
 		saltPrefix = testPrefix
 	} else if args.Server != "" {
 		if server, ok := config.Servers[args.Server]; ok {
+			*settings = *server
 			serverURL = server.Url
 			saltPrefix = server.SaltPrefix
 			username = server.UserName
 		} else {
-			return nil, "", fmt.Errorf("Cannot find %v server info in config", args.Server)
+			return nil, nil, fmt.Errorf("Cannot find %v server info in config", args.Server)
 		}
 	} else if serverURL == "" {
 		serverURL = fmt.Sprintf("https://%v", userapi.ProdAPIHost)
@@ -279,7 +463,29 @@ func apiFromArgs(args Args) (*userapi.CacophonyUserAPI, string, error) {
 	}
 	if args.User != "" {
 		username = args.User
-	} else if username == "" {
+	}
+	if settings.Executor == nil {
+		settings.Executor = config.Executor
+	}
+	if settings.SaltAPI == nil {
+		settings.SaltAPI = config.SaltAPI
+	}
+	if settings.Canaries == nil {
+		settings.Canaries = config.Canaries
+	}
+	settings.Url = serverURL
+	settings.SaltPrefix = saltPrefix
+	settings.UserName = username
+	return config, settings, nil
+}
+
+// apiFromArgs returns an api for the server selected by args along with the resolved server settings
+func apiFromArgs(args ServerArgs) (*userapi.CacophonyUserAPI, *userapi.Server, error) {
+	config, settings, err := serverFromArgs(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if settings.UserName == "" {
 		if config.UserName == "" {
 			getMissingConfig(config)
 			err := config.Save()
@@ -287,15 +493,29 @@ func apiFromArgs(args Args) (*userapi.CacophonyUserAPI, string, error) {
 				fmt.Printf("Error saving config %v\n", err)
 			}
 		}
-		username = config.UserName
+		settings.UserName = config.UserName
 	}
 
-	token, err := userapi.ReadTokenFor(username)
+	token, err := userapi.ReadTokenFor(settings.UserName)
 	if args.Debug && err != nil {
-		fmt.Printf("ReadToken error %v\n", err)
+		fmt.Fprintf(os.Stderr, "ReadToken error %v\n", err)
 	}
-	api := userapi.New(serverURL, username, token)
-	return api, saltPrefix, nil
+	api := userapi.New(settings.Url, settings.UserName, token)
+	return api, settings, nil
+}
+
+// configureExecutor selects how salt is run for the server chosen by args and returns its settings
+func configureExecutor(args ServerArgs) (*userapi.Server, error) {
+	debug = args.Debug
+	config, settings, err := serverFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if settings.UserName == "" {
+		settings.UserName = config.UserName
+	}
+	saltExec, err = newExecutor(settings)
+	return settings, err
 }
 
 func checkForDuplicates(devices *userapi.DeviceResponse) error {
@@ -321,125 +541,315 @@ func checkForDuplicates(devices *userapi.DeviceResponse) error {
 	return nil
 }
 
-// readNodeFile of salt and return a map of node to nodegroup name
-func readNodeFile() map[string][]string {
-	//get all the nodegroups
-	var nodeYaml map[string]map[string]interface{}
-	nodeFile, err := ioutil.ReadFile(nodeGroupFile)
+// translatedDeviceRecords builds a record for every translated device including the
+// nodegroups its salt id belongs to
+func translatedDeviceRecords(devices *userapi.DeviceResponse, server *userapi.Server) ([]deviceRecord, error) {
+	saltPrefix := getSaltPrefix(server.Url, server.SaltPrefix)
+	allDevices := append(append([]userapi.Device{}, devices.NameMatches...), devices.Devices...)
+	minionIDs := make([]string, len(allDevices))
+	for i, device := range allDevices {
+		minionIDs[i] = minionID(saltPrefix, device)
+	}
+	nodesToGroup, err := readNodeGroups(server, minionIDs)
 	if err != nil {
-		fmt.Printf("readNodeFile, error %v ", err)
+		return nil, err
+	}
+	records := make([]deviceRecord, len(allDevices))
+	for i, device := range allDevices {
+		minionID := minionIDs[i]
+		nodeGroups, found := nodesToGroup[minionID]
+		if nodeGroups == nil {
+			// stale devices have no nodegroups, keep them as an empty list in json
+			nodeGroups = []string{}
+		}
+		records[i] = deviceRecord{
+			Group:      device.GroupName,
+			Device:     device.DeviceName,
+			SaltID:     device.SaltId,
+			MinionID:   minionID,
+			NodeGroups: nodeGroups,
+			Stale:      !found,
+		}
 	}
-	err = yaml.Unmarshal(nodeFile, &nodeYaml)
+	return records, nil
+}
+
+func showTranslatedDevices(devices *userapi.DeviceResponse, server *userapi.Server, format string) error {
+	records, err := translatedDeviceRecords(devices, server)
 	if err != nil {
-		fmt.Printf("yaml, error %v ", err)
+		return err
+	}
+	if format != "" && format != outputText {
+		return writeDeviceRecords(os.Stdout, format, records)
 	}
 
-	nodesToGroup := make(map[string][]string)
-	commands := []string{"--preview-target", "-N", "group"}
-	//easiest way to find all pis that belong to a group is to run salt on the
-	//node group with preview-target
-	for key, _ := range nodeYaml["nodegroups"] {
-		commands[2] = key
-		output, err := getSaltOutput(commands...)
-		if err != nil {
-			fmt.Printf("Error getting node targets for %s, err %v\n", key, err)
-			continue
+	fmt.Println("Devices found:")
+	for _, record := range records {
+		if !record.Stale {
+			fmt.Printf("%v:%v saltid: %v nodeGroup %v\n", record.Group, record.Device, record.MinionID, record.NodeGroups)
 		}
-		devices := strings.Split(strings.TrimSpace(output), "\n")
-		for i := 0; i < len(devices); i++ {
-			deviceName := strings.TrimSpace(devices[i])[2:]
-			if _, found := nodesToGroup[deviceName]; !found {
-				nodesToGroup[deviceName] = make([]string, 0, 2)
+	}
+	staleHeader := false
+	for _, record := range records {
+		if record.Stale {
+			if !staleHeader {
+				fmt.Println("\nDevices without any node group (Probably stale):")
+				staleHeader = true
 			}
-			nodesToGroup[deviceName] = append(nodesToGroup[deviceName], key)
+			fmt.Printf("%v:%v saltid: %v\n", record.Group, record.Device, record.MinionID)
 		}
 	}
-	return nodesToGroup
+	return nil
 }
 
-func showTranslatedDevices(devices *userapi.DeviceResponse, saltPrefix string) {
-	nodesToGroup := readNodeFile()
-	noNodeGroup := make([]userapi.Device, 0, 5)
-	fmt.Println("Devices found:")
-	for _, device := range devices.NameMatches {
-		if nodeGroups, found := nodesToGroup[saltPrefix+"-"+strconv.Itoa(device.SaltId)]; found {
-			fmt.Printf("%v:%v saltid: %v nodeGroup %v\n", device.GroupName, device.DeviceName, saltPrefix+"-"+strconv.Itoa(device.SaltId), nodeGroups)
-		} else {
-			noNodeGroup = append(noNodeGroup, device)
+// connect returns an api for the server selected by args, authentication is deferred until
+// the first request
+func connect(args ServerArgs) (*userapi.CacophonyUserAPI, *userapi.Server, error) {
+	debug = args.Debug
+	api, server, err := apiFromArgs(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	saltExec, err = newExecutor(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	if args.Debug {
+		fmt.Fprintf(os.Stderr, "CSalt using server %v, saltprefix %v, user %v\n", api.ServerURL(), server.SaltPrefix, api.User())
+	}
+	api.Debug = debug
+	return api, server, nil
+}
+
+// withAuthentication runs request, authenticating the user first if there is no token or the
+// token is rejected by the server
+func withAuthentication(api *userapi.CacophonyUserAPI, request func() error) error {
+	if !api.HasToken() {
+		if err := authenticateUser(api); err != nil {
+			return err
 		}
 	}
-	for _, device := range devices.Devices {
-		if nodeGroups, found := nodesToGroup[saltPrefix+"-"+strconv.Itoa(device.SaltId)]; found {
-			fmt.Printf("%v:%v saltid: %v nodeGroup %v\n", device.GroupName, device.DeviceName, saltPrefix+"-"+strconv.Itoa(device.SaltId), nodeGroups)
-		} else {
-			noNodeGroup = append(noNodeGroup, device)
+	err := request()
+	if userapi.IsAuthenticationError(err) {
+		if err := authenticateUser(api); err != nil {
+			return err
+		}
+		err = request()
+	}
+	return err
+}
+
+// translateDevices translates the device query into devices with salt ids, failing if any
+// device name is ambiguous
+func translateDevices(api *userapi.CacophonyUserAPI, query *DeviceQuery) (*userapi.DeviceResponse, error) {
+	devResp := &userapi.DeviceResponse{}
+	if len(query.groups) > 0 || len(query.devices) > 0 {
+		err := withAuthentication(api, func() error {
+			var err error
+			devResp, err = api.TranslateNames(query.groups, query.devices)
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
+		if err := checkForDuplicates(devResp); err != nil {
+			return nil, err
+		}
+	}
+	if len(query.lastRun) > 0 {
+		devices, err := lastRunDevices(api.ServerURL(), query.lastRun)
+		if err != nil {
+			return nil, err
+		}
+		addDevices(devResp, devices)
+	}
+	return devResp, nil
+}
+
+// addDevices adds devices to devResp unless they have already been translated
+func addDevices(devResp *userapi.DeviceResponse, devices []userapi.Device) {
+	seen := make(map[string]bool)
+	for _, matches := range [][]userapi.Device{devResp.Devices, devResp.NameMatches} {
+		for _, device := range matches {
+			seen[deviceLabel(device)] = true
+		}
+	}
+	for _, device := range devices {
+		if !seen[deviceLabel(device)] {
+			seen[deviceLabel(device)] = true
+			devResp.Devices = append(devResp.Devices, device)
+		}
+	}
+}
+
+// apiGroupDevices returns every device in every group the user can access
+func apiGroupDevices(api *userapi.CacophonyUserAPI) ([]userapi.Device, error) {
+	var groups []userapi.Group
+	err := withAuthentication(api, func() error {
+		var err error
+		groups, err = api.Groups()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, nil
 	}
-	if len(noNodeGroup) > 0 {
-		fmt.Println("\nDevices without any node group (Probably stale):")
+	query := &DeviceQuery{groups: make([]string, len(groups))}
+	for i, group := range groups {
+		query.groups[i] = group.GroupName
 	}
-	for _, device := range noNodeGroup {
-		fmt.Printf("%v:%v saltid: %v\n", device.GroupName, device.DeviceName, saltPrefix+"-"+strconv.Itoa(device.SaltId))
+	devResp, err := translateDevices(api, query)
+	if err != nil {
+		return nil, err
 	}
+	return devResp.Devices, nil
+}
 
+// confirm asks the user a yes/no question, anything but y or yes is treated as no
+func confirm(question string) bool {
+	fmt.Printf("%v [y/N]: ", question)
+	var answer string
+	fmt.Scanln(&answer)
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
 }
 
 func runMain() error {
 	args := procArgs()
-	debug = args.Debug
+	settings, err := configureExecutor(args.ServerArgs)
+	if err != nil {
+		return err
+	}
 	if len(args.Commands) == 0 {
 		if args.DeviceInfo.RawQuery() {
 			if !args.Show {
-				return runSalt(args.DeviceInfo.rawArg)
+				return runLoggedBinary(settings, "salt", args.DeviceInfo.rawArg)
 			}
 		} else {
 			return errors.New("Commands/deviceinfo must be specified")
 		}
 	} else if !args.DeviceInfo.HasValues() {
-		return runSalt(args.Commands...)
+		return runLoggedBinary(settings, "salt", args.Commands...)
 	}
-	api, saltPrefix, err := apiFromArgs(args)
+	api, server, err := connect(args.ServerArgs)
 	if err != nil {
 		return err
 	}
-
-	if args.Debug {
-		fmt.Printf("CSalt using server %v, saltprefix %v, user %v\n", api.ServerURL(), saltPrefix, api.User())
+	devResp, err := translateDevices(api, &args.DeviceInfo)
+	if err != nil {
+		return err
 	}
-	api.Debug = debug
-	if !api.HasToken() {
-		err = authenticateUser(api)
+	allDevices := append(devResp.Devices, devResp.NameMatches...)
+
+	if args.Show || args.Verbose {
+		err = showTranslatedDevices(devResp, server, args.Output)
 		if err != nil {
 			return err
 		}
 	}
+	if len(args.Commands) > 0 {
+		targets := newTargets(server, allDevices)
+		entry := newRunLogEntry(server, "salt", args.Commands)
+		entry.SetTargets(args.DeviceInfo.rawArg, targets)
+		result := &runResult{}
+		err := runCommands(api, server, args, targets, result)
+		entry.Finish(result.JIDs, err)
+		// every run replaces the last run so @failed never selects devices from an older run
+		if err := recordLastRun(server.Url, args.Commands, result); err != nil {
+			fmt.Printf("Error saving last run %v\n", err)
+		}
+		if stateFunctions[saltFunction(args.Commands)] {
+			printStateSummary(result)
+		}
+		return err
+	}
+	return nil
+}
 
-	devResp, err := api.TranslateNames(args.DeviceInfo.groups, args.DeviceInfo.devices)
-	if userapi.IsAuthenticationError(err) {
-		err = authenticateUser(api)
-
+// runCommands runs the salt commands in args on targets adding the returns to result, pinging
+// and trying canaries first if requested
+func runCommands(api *userapi.CacophonyUserAPI, server *userapi.Server, args Args, targets []target, result *runResult) error {
+	if args.Preflight {
+		pings, err := preflight(targets, args.ChunkSize)
 		if err != nil {
 			return err
 		}
-		devResp, err = api.TranslateNames(args.DeviceInfo.groups, args.DeviceInfo.devices)
-
+		targets = pings.Targets(statusOK)
+		unreachable := pings.Unsuccessful()
+		result.add(unreachable)
+		defer printSkipped(unreachable)
+		if len(targets) == 0 {
+			return errors.New("No devices responded")
+		}
 	}
-	if err != nil {
-		return err
+	if args.Canary > 0 || args.CanaryAlias != "" {
+		var preferred []target
+		if args.CanaryAlias != "" {
+			var err error
+			preferred, err = canaryTargets(api, server, args.CanaryAlias)
+			if err != nil {
+				return err
+			}
+		}
+		var canaries []target
+		canaries, targets = chooseCanaries(targets, preferred, args.Canary)
+		canaryResult, err := runCanaries(canaries, targets, args.Commands, args.Yes, args.perDevice())
+		if canaryResult != nil {
+			result.add(canaryResult)
+		}
+		if err != nil || len(targets) == 0 {
+			return err
+		}
 	}
-
-	err = checkForDuplicates(devResp)
-	if err != nil {
-		return err
+	targetResult, err := runTargets(args, server, targets)
+	if targetResult != nil {
+		result.add(targetResult)
 	}
-	allDevices := append(devResp.Devices, devResp.NameMatches...)
+	return err
+}
 
-	if args.Show || args.Verbose {
-		idPrefix := getSaltPrefix(api.ServerURL(), saltPrefix)
-		showTranslatedDevices(devResp, idPrefix)
+// printSkipped lists the unreachable devices skipped by --preflight
+func printSkipped(unreachable *runResult) {
+	targets := append(unreachable.Targets(statusFailed), unreachable.Targets(statusNoResponse)...)
+	printTargets(fmt.Sprintf("\nSkipped %v unreachable devices:", len(targets)), targets)
+}
+
+// runTargets runs the salt commands in args on targets, in batches or chunks if required
+func runTargets(args Args, server *userapi.Server, targets []target) (*runResult, error) {
+	var result *runResult
+	var err error
+	opts := batchOptions{size: len(targets), name: "chunk", maxFailures: args.MaxFailures, perDevice: args.perDevice(), progress: args.Progress}
+	if stateFunctions[saltFunction(args.Commands)] {
+		// the state summary is printed instead of every state of every device, with the status
+		// line showing the run is still going
+		opts.quiet = true
+		opts.progress = true
+	}
+	switch {
+	case args.Async:
+		if opts.perDevice.enabled(args.Commands) {
+			return nil, errors.New("--async can't be used with --pillar, {group}, {device} or {saltid}")
+		}
+		result, err = submitAsync(targets, args.Commands, args.ChunkSize)
+	case args.Batch.IsSet():
+		opts.size = args.Batch.Size(len(targets))
+		if args.ChunkSize > 0 && args.ChunkSize < opts.size {
+			opts.size = args.ChunkSize
+		}
+		opts.name = "batch"
+		result, err = runBatches(targets, args.Commands, opts)
+	default:
+		// csalt collects every run's returns so they can be recorded for @failed and @noresponse
+		if args.ChunkSize > 0 {
+			opts.size = args.ChunkSize
+		}
+		opts.progress = opts.progress || opts.perDevice.enabled(args.Commands)
+		result, err = runBatches(targets, args.Commands, opts)
 	}
-	if len(args.Commands) > 0 {
-		return runSaltForDevices(api.ServerURL(), allDevices, args.Commands, saltPrefix)
+	if err != nil {
+		return result, err
 	}
-	return nil
+	return result, runError(result)
 }
@@ -0,0 +1,79 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+func TestSubcommandFor(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+		argv []string
+	}{
+		{[]string{"csalt", "audit"}, true, []string{}},
+		{[]string{"csalt", "--prod", "audit"}, true, []string{"--prod"}},
+		{[]string{"csalt", "--server", "f", "jobs", "-n", "5"}, true, []string{"--server", "f", "-n", "5"}},
+		{[]string{"csalt", "--server=f", "-v", "key", "list", "gp"}, true, []string{"--server=f", "-v", "list", "gp"}},
+		{[]string{"csalt", "-o", "json", "-s", "audit"}, true, []string{"-o", "json", "-s"}},
+		{[]string{"csalt", "--server", "jobs", "gp", "test.ping"}, false, nil},
+		{[]string{"csalt", "--chunk-size", "10", "gp", "run"}, false, nil},
+		{[]string{"csalt", "key:", "test.ping"}, false, nil},
+		{[]string{"csalt", "--", "audit"}, false, nil},
+		{[]string{"csalt"}, false, nil},
+	}
+	for _, test := range tests {
+		_, argv, ok := subcommandFor(test.args)
+		if ok != test.ok || (ok && !reflect.DeepEqual(argv, test.argv)) {
+			t.Errorf("subcommandFor(%q) = %q, %v, want %q, %v", test.args, argv, ok, test.argv, test.ok)
+		}
+	}
+}
+
+func TestRunTargetsProgressChunks(t *testing.T) {
+	defer useFakeExecutor(
+		fakeResponse{Command: "salt --out=json --show-jid -L pi-1 pi-2 test.ping", Stdout: "jid: 1\n{\"pi-1\": true}\n{\"pi-2\": true}\n"},
+		fakeResponse{Command: "salt --out=json --show-jid -L pi-3 test.ping", Stdout: "jid: 2\n{\"pi-3\": true}\n"},
+	)()
+	args := Args{Commands: []string{"test.ping"}, Progress: true, ChunkSize: 2, MaxFailures: -1}
+	result, err := runTargets(args, &userapi.Server{}, testTargets(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.JIDs, []string{"1", "2"}) {
+		t.Errorf("JIDs = %v, want a job per chunk", result.JIDs)
+	}
+}
+
+func TestRunTargetsPlain(t *testing.T) {
+	defer useFakeExecutor(fakeResponse{
+		Command: "salt --out=json --show-jid -L pi-1 pi-2 test.ping",
+		Stdout:  "jid: 1\n{\"pi-1\": true}\n",
+	})()
+	args := Args{Commands: []string{"test.ping"}, MaxFailures: -1}
+	result, err := runTargets(args, &userapi.Server{}, testTargets(2))
+	if err == nil {
+		t.Error("expected an error when a device doesn't respond")
+	}
+	want := map[string]string{"pi-1": statusOK, "pi-2": statusNoResponse}
+	if got := statuses(result); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+}
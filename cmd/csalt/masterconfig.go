@@ -0,0 +1,136 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"gopkg.in/yaml.v1"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const (
+	saltMasterConfig         = "/etc/salt/master"
+	saltMasterDefaultInclude = "master.d/*.conf"
+)
+
+// masterConfig holds the parts of a salt master config file csalt is interested in
+type masterConfig struct {
+	DefaultInclude string                 `yaml:"default_include"`
+	Include        interface{}            `yaml:"include"`
+	NodeGroups     map[string]interface{} `yaml:"nodegroups"`
+}
+
+// nodeGroupConfig is the merged nodegroup definitions and the contents they were read from
+type nodeGroupConfig struct {
+	contents   []byte
+	nodeGroups map[string]interface{}
+}
+
+// nodeGroupFiles returns the files nodegroups should be read from for server. Files listed in
+// nodegroup-files are used as is, otherwise the salt master config and its includes are used
+func nodeGroupFiles(server *userapi.Server) ([]string, error) {
+	if len(server.NodeGroupFiles) > 0 {
+		return server.NodeGroupFiles, nil
+	}
+	masterPath := server.MasterConfig
+	if masterPath == "" {
+		masterPath = saltMasterConfig
+	}
+
+	var master masterConfig
+	buf, err := saltExec.ReadFile(masterPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Error reading salt master config %v", err)
+	} else if err == nil {
+		if err := yaml.Unmarshal(buf, &master); err != nil {
+			return nil, fmt.Errorf("Error parsing salt master config %v: %v", masterPath, err)
+		}
+	}
+
+	files := []string{masterPath}
+	defaultInclude := master.DefaultInclude
+	if defaultInclude == "" {
+		defaultInclude = saltMasterDefaultInclude
+	}
+	includes := []string{defaultInclude}
+	switch include := master.Include.(type) {
+	case string:
+		includes = append(includes, include)
+	case []interface{}:
+		for _, item := range include {
+			includes = append(includes, fmt.Sprint(item))
+		}
+	}
+
+	configDir := path.Dir(masterPath)
+	for _, include := range includes {
+		if !path.IsAbs(include) {
+			include = path.Join(configDir, include)
+		}
+		matches, err := saltExec.Glob(include)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid salt master include %v: %v", include, err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// readNodeGroupConfig reads and merges the nodegroups defined in the supplied files, later files
+// override nodegroups of the same name as salt does
+func readNodeGroupConfig(files []string) (*nodeGroupConfig, error) {
+	conf := &nodeGroupConfig{nodeGroups: make(map[string]interface{})}
+	for _, file := range files {
+		buf, err := saltExec.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading nodegroups %v", err)
+		}
+		var master masterConfig
+		if err := yaml.Unmarshal(buf, &master); err != nil {
+			return nil, fmt.Errorf("Error parsing nodegroups %v: %v", file, err)
+		}
+		conf.contents = append(conf.contents, file...)
+		conf.contents = append(conf.contents, buf...)
+		for name, def := range master.NodeGroups {
+			conf.nodeGroups[name] = def
+		}
+	}
+	return conf, nil
+}
+
+// readNodeGroups of salt and return a map of the supplied minion ids to nodegroup names
+func readNodeGroups(server *userapi.Server, minionIDs []string) (map[string][]string, error) {
+	files, err := nodeGroupFiles(server)
+	if err != nil {
+		return nil, err
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "Reading nodegroups from %v\n", files)
+	}
+	conf, err := readNodeGroupConfig(files)
+	if err != nil {
+		return nil, err
+	}
+	return nodeGroupsFor(newNodeGroupDefs(conf.nodeGroups), executorID(server), hashNodeGroupConfig(conf.contents), minionIDs)
+}
@@ -0,0 +1,496 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	nodeGroupCacheFile = "nodegroups-cache.yaml"
+	nodeGroupWorkers   = 4
+)
+
+// matcher reports whether a minion id is targeted by a nodegroup expression
+type matcher interface {
+	Match(minionID string) bool
+}
+
+type globMatcher string
+
+func (g globMatcher) Match(minionID string) bool {
+	matched, _ := path.Match(string(g), minionID)
+	return matched
+}
+
+type listMatcher map[string]bool
+
+func (l listMatcher) Match(minionID string) bool {
+	return l[minionID]
+}
+
+type regexMatcher struct {
+	re *regexp.Regexp
+}
+
+func (r regexMatcher) Match(minionID string) bool {
+	return r.re.MatchString(minionID)
+}
+
+type notMatcher struct {
+	m matcher
+}
+
+func (n notMatcher) Match(minionID string) bool {
+	return !n.m.Match(minionID)
+}
+
+type andMatcher []matcher
+
+func (a andMatcher) Match(minionID string) bool {
+	for _, m := range a {
+		if !m.Match(minionID) {
+			return false
+		}
+	}
+	return true
+}
+
+type orMatcher []matcher
+
+func (o orMatcher) Match(minionID string) bool {
+	for _, m := range o {
+		if m.Match(minionID) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedError is returned when a nodegroup uses a matcher that can only be
+// evaluated by salt e.g. grains or pillar
+type unsupportedError struct {
+	term string
+}
+
+func (e *unsupportedError) Error() string {
+	return fmt.Sprintf("unsupported nodegroup term %v", e.term)
+}
+
+// hashNodeGroupConfig returns a hex sha256 of the nodegroup config contents
+func hashNodeGroupConfig(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// nodeGroupDefs holds the raw nodegroup definitions and compiles them on demand
+type nodeGroupDefs struct {
+	defs     map[string]interface{}
+	compiled map[string]matcher
+	errs     map[string]error
+	visiting map[string]bool
+}
+
+func newNodeGroupDefs(defs map[string]interface{}) *nodeGroupDefs {
+	return &nodeGroupDefs{
+		defs:     defs,
+		compiled: make(map[string]matcher),
+		errs:     make(map[string]error),
+		visiting: make(map[string]bool),
+	}
+}
+
+// Names returns the sorted nodegroup names
+func (n *nodeGroupDefs) Names() []string {
+	names := make([]string, 0, len(n.defs))
+	for name := range n.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Compile returns a matcher for the named nodegroup or an error if it references
+// unknown nodegroups or matchers csalt cannot evaluate
+func (n *nodeGroupDefs) Compile(name string) (matcher, error) {
+	if m, ok := n.compiled[name]; ok {
+		return m, nil
+	}
+	if err, ok := n.errs[name]; ok {
+		return nil, err
+	}
+	def, ok := n.defs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown nodegroup %v", name)
+	}
+	if n.visiting[name] {
+		return nil, fmt.Errorf("nodegroup %v references itself", name)
+	}
+	n.visiting[name] = true
+	defer delete(n.visiting, name)
+
+	var m matcher
+	var err error
+	switch value := def.(type) {
+	case string:
+		m, err = n.parse(tokenizeCompound(value))
+	case []interface{}:
+		words := make([]string, len(value))
+		for i, word := range value {
+			words[i] = fmt.Sprint(word)
+		}
+		if isPlainList(words) {
+			m = newListMatcher(words)
+		} else {
+			m, err = n.parse(tokenizeCompound(strings.Join(words, " ")))
+		}
+	default:
+		err = fmt.Errorf("nodegroup %v has an invalid definition", name)
+	}
+	if err != nil {
+		n.errs[name] = err
+		return nil, err
+	}
+	n.compiled[name] = m
+	return m, nil
+}
+
+// isPlainList returns true if words is a list of minion ids rather than compound terms,
+// salt treats these nodegroups as an L@ list
+func isPlainList(words []string) bool {
+	for _, word := range words {
+		switch word {
+		case "and", "or", "not", "(", ")":
+			return false
+		}
+		if strings.Contains(word, "@") {
+			return false
+		}
+	}
+	return true
+}
+
+func newListMatcher(ids []string) listMatcher {
+	list := make(listMatcher)
+	for _, id := range ids {
+		list[strings.TrimSpace(id)] = true
+	}
+	return list
+}
+
+// tokenizeCompound splits a compound expression into words, separating parentheses. A ) ending a
+// term such as E@pi-(1|2) is kept when it closes a ( in the term's value
+func tokenizeCompound(expr string) []string {
+	var tokens []string
+	for _, word := range strings.Fields(expr) {
+		for strings.HasPrefix(word, "(") {
+			tokens = append(tokens, "(")
+			word = word[1:]
+		}
+		closing := 0
+		for strings.HasSuffix(word, ")") && strings.Count(word, ")") > strings.Count(word, "(") {
+			closing++
+			word = word[:len(word)-1]
+		}
+		if word != "" {
+			tokens = append(tokens, word)
+		}
+		for i := 0; i < closing; i++ {
+			tokens = append(tokens, ")")
+		}
+	}
+	return tokens
+}
+
+// parse builds a matcher from compound tokens using python operator precedence as salt does
+func (n *nodeGroupDefs) parse(tokens []string) (matcher, error) {
+	p := &compoundParser{tokens: tokens, defs: n}
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %v in compound expression", p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+type compoundParser struct {
+	tokens []string
+	pos    int
+	defs   *nodeGroupDefs
+}
+
+func (p *compoundParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *compoundParser) parseOr() (matcher, error) {
+	m, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	matchers := orMatcher{m}
+	for p.peek() == "or" {
+		p.pos++
+		m, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	if len(matchers) == 1 {
+		return matchers[0], nil
+	}
+	return matchers, nil
+}
+
+func (p *compoundParser) parseAnd() (matcher, error) {
+	m, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	matchers := andMatcher{m}
+	for p.peek() == "and" {
+		p.pos++
+		m, err = p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	if len(matchers) == 1 {
+		return matchers[0], nil
+	}
+	return matchers, nil
+}
+
+func (p *compoundParser) parseNot() (matcher, error) {
+	if p.peek() == "not" {
+		p.pos++
+		m, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notMatcher{m}, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *compoundParser) parseTerm() (matcher, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of compound expression")
+	}
+	p.pos++
+	if token == "(" {
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in compound expression")
+		}
+		p.pos++
+		return m, nil
+	}
+
+	pos := strings.Index(token, "@")
+	if pos < 0 {
+		return globMatcher(token), nil
+	}
+	value := token[pos+1:]
+	switch token[:pos] {
+	case "L":
+		return newListMatcher(strings.Split(value, ",")), nil
+	case "N":
+		return p.defs.Compile(value)
+	case "E":
+		re, err := regexp.Compile("^(?:" + value + ")")
+		if err != nil {
+			return nil, &unsupportedError{term: token}
+		}
+		return regexMatcher{re: re}, nil
+	}
+	return nil, &unsupportedError{term: token}
+}
+
+// nodeGroupCache stores the nodegroups resolved by salt, it is only valid while the
+// nodegroup definitions hash to the same value
+type nodeGroupCache struct {
+	Hash    string              `yaml:"hash"`
+	Targets map[string][]string `yaml:"targets"`
+}
+
+// nodeGroupCaches holds a nodeGroupCache for each salt master, identified by executorID, as
+// masters with the same nodegroup definitions can still target different minions
+type nodeGroupCaches struct {
+	Masters map[string]*nodeGroupCache `yaml:"masters"`
+}
+
+// nodeGroupsFor evaluates every nodegroup against the supplied minion ids and returns a map
+// of minion id to nodegroup names. Nodegroups csalt cannot evaluate are resolved by salt
+// and cached for the master against the hash of the nodegroup definitions
+func nodeGroupsFor(defs *nodeGroupDefs, master, hash string, minionIDs []string) (map[string][]string, error) {
+	nodesToGroup := make(map[string][]string)
+	var unresolved []string
+	for _, name := range defs.Names() {
+		m, err := defs.Compile(name)
+		if err != nil {
+			if debug {
+				fmt.Fprintf(os.Stderr, "Resolving nodegroup %v with salt: %v\n", name, err)
+			}
+			unresolved = append(unresolved, name)
+			continue
+		}
+		for _, minionID := range minionIDs {
+			if m.Match(minionID) {
+				nodesToGroup[minionID] = append(nodesToGroup[minionID], name)
+			}
+		}
+	}
+	if len(unresolved) == 0 {
+		return nodesToGroup, nil
+	}
+
+	targets := cachedPreviewNodeGroups(master, hash, unresolved)
+	for _, name := range unresolved {
+		for _, minionID := range targets[name] {
+			nodesToGroup[minionID] = append(nodesToGroup[minionID], name)
+		}
+	}
+	for _, groups := range nodesToGroup {
+		sort.Strings(groups)
+	}
+	return nodesToGroup, nil
+}
+
+// cachedPreviewNodeGroups returns the targets of the supplied nodegroups from the cache of master
+// if its nodegroup definitions are unchanged, otherwise resolves them with salt. Nodegroups salt
+// failed to resolve are left out of the cache so they are tried again next time
+func cachedPreviewNodeGroups(master, hash string, names []string) map[string][]string {
+	var caches nodeGroupCaches
+	if err := readStateFile(nodeGroupCacheFile, &caches); err != nil && debug {
+		fmt.Fprintf(os.Stderr, "Error reading nodegroup cache %v\n", err)
+	}
+	if cache := caches.Masters[master]; cache != nil && cache.Hash == hash && cache.Targets != nil {
+		missing := false
+		for _, name := range names {
+			if _, ok := cache.Targets[name]; !ok {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			return cache.Targets
+		}
+	}
+
+	targets := previewNodeGroups(names)
+	err := updateStateFile(nodeGroupCacheFile, &caches, func() error {
+		if caches.Masters == nil {
+			caches.Masters = make(map[string]*nodeGroupCache)
+		}
+		caches.Masters[master] = &nodeGroupCache{Hash: hash, Targets: targets}
+		return nil
+	})
+	if err != nil && debug {
+		fmt.Fprintf(os.Stderr, "Error saving nodegroup cache %v\n", err)
+	}
+	return targets
+}
+
+// previewNodeGroups resolves the supplied nodegroups with salt using a bounded pool of workers.
+// Nodegroups salt fails to resolve are reported and left out of the returned targets
+func previewNodeGroups(names []string) map[string][]string {
+	type result struct {
+		name    string
+		targets []string
+		err     error
+	}
+	jobs := make(chan string)
+	results := make(chan result)
+	// salt runs one preview at a time unless the executor can run several without their
+	// password prompts colliding
+	workers := 1
+	if e, ok := saltExec.(concurrentExecutor); ok {
+		if err := e.prepareConcurrent(); err != nil {
+			fmt.Fprintf(os.Stderr, "Resolving nodegroups one at a time: %v\n", err)
+		} else {
+			workers = nodeGroupWorkers
+		}
+	}
+	if len(names) < workers {
+		workers = len(names)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for name := range jobs {
+				targets, err := previewNodeGroup(name)
+				results <- result{name: name, targets: targets, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, name := range names {
+			jobs <- name
+		}
+		close(jobs)
+	}()
+
+	targets := make(map[string][]string, len(names))
+	var errs []string
+	for range names {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, fmt.Sprintf("%v, err %v", res.name, res.err))
+			continue
+		}
+		targets[res.name] = res.targets
+	}
+	sort.Strings(errs)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Error getting node targets for %v\n", err)
+	}
+	return targets
+}
+
+// previewNodeGroup asks salt for the minions targeted by the nodegroup
+func previewNodeGroup(name string) ([]string, error) {
+	output, err := getSaltOutput("--preview-target", "-N", name)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	targets := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "- ")
+		if line != "" {
+			targets = append(targets, line)
+		}
+	}
+	return targets, nil
+}
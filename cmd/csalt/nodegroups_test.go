@@ -0,0 +1,137 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeCompound(t *testing.T) {
+	tests := []struct {
+		expr   string
+		tokens []string
+	}{
+		{"L@pi-1,pi-2", []string{"L@pi-1,pi-2"}},
+		{"(N@a or L@pi-9)", []string{"(", "N@a", "or", "L@pi-9", ")"}},
+		{"((pi-1 or pi-2)) and not N@b", []string{"(", "(", "pi-1", "or", "pi-2", ")", ")", "and", "not", "N@b"}},
+		{"( pi-1 or E@pi-(1|2) )", []string{"(", "pi-1", "or", "E@pi-(1|2)", ")"}},
+		{"(E@pi-(1|2))", []string{"(", "E@pi-(1|2)", ")"}},
+		{"  pi-*  ", []string{"pi-*"}},
+	}
+	for _, test := range tests {
+		if tokens := tokenizeCompound(test.expr); !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("tokenizeCompound(%q) = %q, want %q", test.expr, tokens, test.tokens)
+		}
+	}
+}
+
+func TestNodeGroupCompile(t *testing.T) {
+	defs := newNodeGroupDefs(map[string]interface{}{
+		"list":     "L@pi-1,pi-2",
+		"glob":     "pi-1*",
+		"plain":    []interface{}{"pi-3", "pi-4"},
+		"nested":   "(N@list or L@pi-9) and not pi-2",
+		"regex":    "E@pi-(1|2)$",
+		"combined": []interface{}{"N@plain", "or", "(E@pi-(5|6)$)"},
+		"grain":    "G@os:Debian",
+		"loop":     "N@loop or pi-1",
+		"unknown":  "N@missing",
+		"unclosed": "(pi-1 or pi-2",
+		"dangling": "pi-1 and",
+	})
+	minionIDs := []string{"pi-1", "pi-2", "pi-3", "pi-4", "pi-5", "pi-6", "pi-9", "pi-10", "pi-12"}
+	tests := map[string][]string{
+		"list":     {"pi-1", "pi-2"},
+		"glob":     {"pi-1", "pi-10", "pi-12"},
+		"plain":    {"pi-3", "pi-4"},
+		"nested":   {"pi-1", "pi-9"},
+		"regex":    {"pi-1", "pi-2"},
+		"combined": {"pi-3", "pi-4", "pi-5", "pi-6"},
+	}
+	for name, want := range tests {
+		m, err := defs.Compile(name)
+		if err != nil {
+			t.Errorf("Compile(%v) failed: %v", name, err)
+			continue
+		}
+		var matched []string
+		for _, id := range minionIDs {
+			if m.Match(id) {
+				matched = append(matched, id)
+			}
+		}
+		if !reflect.DeepEqual(matched, want) {
+			t.Errorf("nodegroup %v matched %v, want %v", name, matched, want)
+		}
+	}
+	for _, name := range []string{"loop", "unknown", "unclosed", "dangling"} {
+		if _, err := defs.Compile(name); err == nil {
+			t.Errorf("Compile(%v) should fail", name)
+		}
+	}
+	// salt resolves the matchers csalt can't evaluate
+	if _, err := defs.Compile("grain"); err == nil {
+		t.Error("Compile(grain) should fail")
+	} else if _, ok := err.(*unsupportedError); !ok {
+		t.Errorf("Compile(grain) failed with %v, want an unsupported matcher error", err)
+	}
+}
+
+func TestNodeGroupsForPreviewFailure(t *testing.T) {
+	defer useTempState(t)()
+	defer useFakeExecutor(
+		fakeResponse{Command: "salt --preview-target -N grain", Stdout: "- pi-1\n- pi-2\n"},
+		fakeResponse{Command: "salt --preview-target -N broken", Stderr: "No minions matched\n", Exit: 1},
+	)()
+	defs := newNodeGroupDefs(map[string]interface{}{
+		"list":   "L@pi-1",
+		"grain":  "G@os:Debian",
+		"broken": "G@os:Other",
+	})
+	nodesToGroup, err := nodeGroupsFor(defs, "fake", "hash", []string{"pi-1", "pi-2", "pi-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"pi-1": {"grain", "list"}, "pi-2": {"grain"}}
+	if !reflect.DeepEqual(nodesToGroup, want) {
+		t.Errorf("nodegroups = %v, want %v", nodesToGroup, want)
+	}
+}
+
+func TestNodeGroupCachePerMaster(t *testing.T) {
+	defer useTempState(t)()
+	defs := newNodeGroupDefs(map[string]interface{}{"grain": "G@os:Debian"})
+	minionIDs := []string{"pi-1", "pi-2"}
+	resolve := func(master string, responses ...fakeResponse) map[string][]string {
+		defer useFakeExecutor(responses...)()
+		nodesToGroup, err := nodeGroupsFor(defs, master, "hash", minionIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nodesToGroup
+	}
+
+	a := resolve("ssh a", fakeResponse{Command: "salt --preview-target -N grain", Stdout: "- pi-1\n"})
+	b := resolve("ssh b", fakeResponse{Command: "salt --preview-target -N grain", Stdout: "- pi-2\n"})
+	if !reflect.DeepEqual(a, map[string][]string{"pi-1": {"grain"}}) || !reflect.DeepEqual(b, map[string][]string{"pi-2": {"grain"}}) {
+		t.Errorf("master a = %v, master b = %v, want each master's own preview", a, b)
+	}
+	// without scripted responses the cached targets of master a must be used
+	if cached := resolve("ssh a"); !reflect.DeepEqual(cached, a) {
+		t.Errorf("cached nodegroups of master a = %v, want %v", cached, a)
+	}
+}
@@ -0,0 +1,209 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"gopkg.in/yaml.v1"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const (
+	managedNodeGroupFile   = "master.d/cacophony-groups.conf"
+	managedNodeGroupHeader = "# Managed by csalt nodegroups sync, changes to this file will be overwritten\n"
+)
+
+type NodeGroupsArgs struct {
+	Action string `arg:"positional,required" help:"sync"`
+	File   string `help:"Managed nodegroups file, defaults to master.d/cacophony-groups.conf next to the salt master config"`
+	Yes    bool   `arg:"-y" help:"Write the nodegroups file without asking for confirmation"`
+	ServerArgs
+}
+
+func (NodeGroupsArgs) Description() string {
+	return `Manage salt nodegroups generated from Cacophony API groups.
+
+sync: writes a nodegroup for every API group listing the minion ids of its devices,
+so salt -N groupname targets the same devices as csalt "groupname:"`
+}
+
+// managedNodeGroups is the nodegroups section of the managed nodegroups file
+type managedNodeGroups struct {
+	NodeGroups map[string][]string `yaml:"nodegroups"`
+}
+
+func runNodeGroups(argv []string) error {
+	var args NodeGroupsArgs
+	p := parseSubcommand("nodegroups", argv, &args)
+	if args.Action != "sync" {
+		p.Fail(fmt.Sprintf("unknown nodegroups action %v", args.Action))
+	}
+	api, server, err := connect(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	return syncNodeGroups(api, server, args.File, args.Yes)
+}
+
+// syncNodeGroups writes every api group as a nodegroup to file after showing the changes and
+// asking for confirmation
+func syncNodeGroups(api *userapi.CacophonyUserAPI, server *userapi.Server, file string, yes bool) error {
+	if file == "" {
+		masterPath := server.MasterConfig
+		if masterPath == "" {
+			masterPath = saltMasterConfig
+		}
+		file = path.Join(path.Dir(masterPath), managedNodeGroupFile)
+	}
+
+	devices, err := apiGroupDevices(api)
+	if err != nil {
+		return err
+	}
+	idPrefix := getSaltPrefix(server.Url, server.SaltPrefix)
+	wanted := make(map[string][]string)
+	labels := make(map[string]string)
+	for _, device := range devices {
+		id := minionID(idPrefix, device)
+		wanted[device.GroupName] = append(wanted[device.GroupName], id)
+		labels[id] = deviceLabel(device)
+	}
+	for _, ids := range wanted {
+		sort.Strings(ids)
+	}
+
+	current, err := readManagedNodeGroups(file)
+	if err != nil {
+		return err
+	}
+	if !printNodeGroupDiff(current, wanted, labels) {
+		fmt.Printf("%v is up to date\n", file)
+		return nil
+	}
+	if !yes && !confirm(fmt.Sprintf("Write %v nodegroups to %v?", len(wanted), file)) {
+		return errors.New("Nodegroups not written")
+	}
+
+	buf, err := yaml.Marshal(&managedNodeGroups{NodeGroups: wanted})
+	if err != nil {
+		return err
+	}
+	err = writeMasterFile(file, append([]byte(managedNodeGroupHeader), buf...))
+	if err != nil {
+		return err
+	}
+	fmt.Println("Restart the salt-master to load the new nodegroups")
+	return nil
+}
+
+// readManagedNodeGroups reads the nodegroups of a previously written managed file
+func readManagedNodeGroups(file string) (map[string][]string, error) {
+	buf, err := saltExec.ReadFile(file)
+	if os.IsNotExist(err) {
+		return map[string][]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var master masterConfig
+	if err := yaml.Unmarshal(buf, &master); err != nil {
+		return nil, fmt.Errorf("Error parsing nodegroups %v: %v", file, err)
+	}
+	nodeGroups := make(map[string][]string)
+	for name, def := range master.NodeGroups {
+		switch value := def.(type) {
+		case []interface{}:
+			for _, id := range value {
+				nodeGroups[name] = append(nodeGroups[name], fmt.Sprint(id))
+			}
+		default:
+			nodeGroups[name] = []string{fmt.Sprint(value)}
+		}
+	}
+	return nodeGroups, nil
+}
+
+// printNodeGroupDiff prints the nodegroups and minions that will be added or removed, returning
+// false if there are no changes
+func printNodeGroupDiff(current, wanted map[string][]string, labels map[string]string) bool {
+	names := make([]string, 0, len(current)+len(wanted))
+	for name := range current {
+		names = append(names, name)
+	}
+	for name := range wanted {
+		if _, ok := current[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changed := false
+	for _, name := range names {
+		currentIDs, inCurrent := current[name]
+		wantedIDs, inWanted := wanted[name]
+		added := difference(wantedIDs, currentIDs)
+		removed := difference(currentIDs, wantedIDs)
+		switch {
+		case !inCurrent:
+			fmt.Printf("+ %v (new nodegroup)\n", name)
+		case !inWanted:
+			fmt.Printf("- %v (removed nodegroup)\n", name)
+		case len(added) > 0 || len(removed) > 0:
+			fmt.Printf("~ %v\n", name)
+		default:
+			continue
+		}
+		changed = true
+		for _, id := range added {
+			fmt.Printf("    + %v %v\n", id, labels[id])
+		}
+		for _, id := range removed {
+			fmt.Printf("    - %v\n", id)
+		}
+	}
+	return changed
+}
+
+// difference returns the items of a that are not in b
+func difference(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, item := range b {
+		inB[item] = true
+	}
+	var diff []string
+	for _, item := range a {
+		if !inB[item] {
+			diff = append(diff, item)
+		}
+	}
+	return diff
+}
+
+// writeMasterFile writes data to a file on the salt master
+func writeMasterFile(file string, data []byte) error {
+	return saltExec.Run(&saltCmd{
+		binary: "tee",
+		args:   []string{file},
+		stdin:  bytes.NewReader(data),
+		stderr: os.Stderr,
+	})
+}
@@ -0,0 +1,106 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v1"
+)
+
+const (
+	outputText  = "text"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputCSV   = "csv"
+	outputTable = "table"
+)
+
+// deviceRecord describes a translated device for machine readable output
+type deviceRecord struct {
+	Group      string   `json:"group" yaml:"group"`
+	Device     string   `json:"device" yaml:"device"`
+	SaltID     int      `json:"saltId" yaml:"saltId"`
+	MinionID   string   `json:"minionId" yaml:"minionId"`
+	NodeGroups []string `json:"nodeGroups" yaml:"nodeGroups"`
+	Stale      bool     `json:"stale" yaml:"stale"`
+}
+
+// validOutputFormat returns an error if format is not a supported --output value
+func validOutputFormat(format string) error {
+	switch format {
+	case "", outputText, outputJSON, outputYAML, outputCSV, outputTable:
+		return nil
+	}
+	return fmt.Errorf("Unknown output format %v, expected one of json, yaml, csv, table", format)
+}
+
+// writeDeviceRecords writes records to w in the supplied format
+func writeDeviceRecords(w io.Writer, format string, records []deviceRecord) error {
+	rows := make([][]string, len(records))
+	for i, record := range records {
+		rows[i] = []string{
+			record.Group,
+			record.Device,
+			strconv.Itoa(record.SaltID),
+			record.MinionID,
+			strings.Join(record.NodeGroups, ";"),
+			strconv.FormatBool(record.Stale),
+		}
+	}
+	header := []string{"group", "device", "saltId", "minionId", "nodeGroups", "stale"}
+	return writeRecords(w, format, records, header, rows)
+}
+
+// writeRecords writes records to w in the supplied format. json and yaml are marshalled from
+// records while csv and table are written from header and rows
+func writeRecords(w io.Writer, format string, records interface{}, header []string, rows [][]string) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case outputYAML:
+		buf, err := yaml.Marshal(records)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	case outputCSV:
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write(header)
+		for _, row := range rows {
+			csvWriter.Write(row)
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown output format %v", format)
+}
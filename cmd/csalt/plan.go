@@ -0,0 +1,166 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxPlanOutliers is the most devices named as outliers for a state
+const maxPlanOutliers = 5
+
+type PlanArgs struct {
+	DeviceInfo DeviceQuery `arg:"positional,required"`
+	States     []string    `arg:"positional" help:"States to apply, the highstate if none are given"`
+	ChunkSize  int         `arg:"--chunk-size" help:"Run salt on at most this many devices at a time"`
+	ServerArgs
+}
+
+func (PlanArgs) Description() string {
+	return `Preview the changes state.apply would make by running it with test=True and grouping the
+pending changes by state across the devices. Devices that differ from the rest are named.
+
+Example:
+csalt plan "group1:,group2:" cacophony-api
+pkg.installed cacophony-api: would change on 37 of 40 devices, not on group1:gp, group2:cam1, group2:cam2`
+}
+
+// planState is a state that would change on some devices
+type planState struct {
+	Name    string
+	Changes []target
+	// Present are all the devices the state ran on
+	Present []target
+}
+
+func runPlan(argv []string) error {
+	args := PlanArgs{ChunkSize: defaultChunkSize}
+	parseSubcommand("plan", argv, &args)
+	api, server, err := connect(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	devResp, err := translateDevices(api, &args.DeviceInfo)
+	if err != nil {
+		return err
+	}
+	targets := newTargets(server, append(devResp.Devices, devResp.NameMatches...))
+	if len(targets) == 0 {
+		return errors.New("No valid devices found")
+	}
+	commands := []string{"state.apply"}
+	if len(args.States) > 0 {
+		commands = append(commands, strings.Join(args.States, ","))
+	}
+	commands = append(commands, "test=True")
+	size := args.ChunkSize
+	if size <= 0 {
+		size = len(targets)
+	}
+
+	entry := newRunLogEntry(server, "salt", commands)
+	entry.SetTargets(args.DeviceInfo.rawArg, targets)
+	result, err := runBatches(targets, commands, batchOptions{size: size, name: "chunk", maxFailures: -1, quiet: true, progress: true})
+	entry.Finish(result.JIDs, err)
+	if err != nil {
+		return err
+	}
+	printPlan(planStates(result), len(targets))
+	printStateSummary(result)
+	return nil
+}
+
+// planStates groups the states that would change by name, most widespread first
+func planStates(result *runResult) []*planState {
+	states := make(map[string]*planState)
+	for _, res := range result.Results {
+		returns, keys, err := parseStateReturns(res.Return)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			name := stateName(key)
+			state, ok := states[name]
+			if !ok {
+				state = &planState{Name: name}
+				states[name] = state
+			}
+			state.Present = append(state.Present, res.target)
+			if ret := returns[key]; ret.Result == nil || len(ret.Changes) > 0 {
+				state.Changes = append(state.Changes, res.target)
+			}
+		}
+	}
+	var changing []*planState
+	for _, state := range states {
+		if len(state.Changes) > 0 {
+			changing = append(changing, state)
+		}
+	}
+	sort.Slice(changing, func(i, j int) bool {
+		if len(changing[i].Changes) != len(changing[j].Changes) {
+			return len(changing[i].Changes) > len(changing[j].Changes)
+		}
+		return changing[i].Name < changing[j].Name
+	})
+	return changing
+}
+
+// printPlan prints how many devices each state would change on, naming the outliers when only a
+// few devices change, or only a few devices don't
+func printPlan(states []*planState, total int) {
+	fmt.Printf("\nPlan for %v devices:\n", total)
+	if len(states) == 0 {
+		fmt.Println("No changes")
+		return
+	}
+	for _, state := range states {
+		line := fmt.Sprintf("%v: would change on %v of %v devices", state.Name, len(state.Changes), len(state.Present))
+		unchanged := targetDifference(state.Present, state.Changes)
+		if len(state.Changes) <= maxPlanOutliers && len(state.Changes) < len(unchanged) {
+			line += ": " + targetLabels(state.Changes)
+		} else if len(unchanged) > 0 && len(unchanged) <= maxPlanOutliers && len(unchanged) < len(state.Changes) {
+			line += ", not on " + targetLabels(unchanged)
+		}
+		fmt.Println(line)
+	}
+}
+
+// targetDifference returns the targets in a that are not in b
+func targetDifference(a, b []target) []target {
+	inB := make(map[string]bool, len(b))
+	for _, t := range b {
+		inB[t.MinionID] = true
+	}
+	var diff []target
+	for _, t := range a {
+		if !inB[t.MinionID] {
+			diff = append(diff, t)
+		}
+	}
+	return diff
+}
+
+func targetLabels(targets []target) string {
+	labels := make([]string, len(targets))
+	for i, t := range targets {
+		labels[i] = t.Label()
+	}
+	return strings.Join(labels, ", ")
+}
@@ -0,0 +1,40 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+// preflight pings targets and reports the devices that didn't respond
+func preflight(targets []target, chunkSize int) (*runResult, error) {
+	if chunkSize <= 0 {
+		chunkSize = len(targets)
+	}
+	fmt.Printf("Pinging %v devices\n", len(targets))
+	result := &runResult{}
+	for _, chunk := range chunkTargets(targets, chunkSize) {
+		chunkResult, err := collectSalt(chunk, []string{"test.ping"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.add(chunkResult)
+	}
+	fmt.Printf("%v of %v devices responded\n", result.Count(statusOK), len(targets))
+	unreachable := result.Unsuccessful()
+	printTargets("unreachable:", append(unreachable.Targets(statusFailed), unreachable.Targets(statusNoResponse)...))
+	return result, nil
+}
@@ -0,0 +1,162 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressRefresh is how often the status line is redrawn on a terminal
+	progressRefresh = time.Second
+	// plainProgressInterval is how often progress is printed when stdout is not a terminal
+	plainProgressInterval = 30 * time.Second
+	// progressNamesShown is how many outstanding devices the status line names
+	progressNamesShown = 3
+)
+
+// stdoutIsTerminal returns true if stdout is a terminal rather than a file or pipe
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progress prints each return as it arrives along with the number of returns, failures and
+// the devices still outstanding. On a terminal the status is a single line redrawn in place,
+// otherwise a plain progress line is printed every plainProgressInterval
+type progress struct {
+	mu           sync.Mutex
+	tty          bool
+	printReturns bool
+	showStatus   bool
+	targets      []target
+	returned     map[string]bool
+	failed       int
+	noResponse   int
+	start        time.Time
+	lastPrinted  time.Time
+	stop         chan struct{}
+	stopped      sync.WaitGroup
+}
+
+// startProgress starts following a salt run on targets, printing each device's return if
+// printReturns is set and the status if showStatus is set
+func startProgress(targets []target, printReturns, showStatus bool) *progress {
+	p := &progress{
+		tty:          stdoutIsTerminal(),
+		printReturns: printReturns,
+		showStatus:   showStatus,
+		targets:      targets,
+		returned:     make(map[string]bool, len(targets)),
+		start:        time.Now(),
+		lastPrinted:  time.Now(),
+		stop:         make(chan struct{}),
+	}
+	if showStatus {
+		p.stopped.Add(1)
+		go p.refresh()
+	}
+	return p
+}
+
+func (p *progress) refresh() {
+	defer p.stopped.Done()
+	ticker := time.NewTicker(progressRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			if p.tty {
+				p.drawStatus()
+			} else if time.Since(p.lastPrinted) >= plainProgressInterval {
+				fmt.Println(p.status())
+				p.lastPrinted = time.Now()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// Result prints a device's return and updates the progress, it is safe to use as the onResult
+// of collectSalt
+func (p *progress) Result(res minionResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.printReturns {
+		p.clearStatus()
+		printMinionResult(res)
+	}
+	p.returned[res.MinionID] = true
+	switch res.Status {
+	case statusFailed:
+		p.failed++
+	case statusNoResponse:
+		p.noResponse++
+	}
+	p.drawStatus()
+}
+
+// Stop stops showing progress and removes the status line
+func (p *progress) Stop() {
+	close(p.stop)
+	p.stopped.Wait()
+	p.mu.Lock()
+	p.clearStatus()
+	p.mu.Unlock()
+}
+
+func (p *progress) clearStatus() {
+	if p.tty && p.showStatus {
+		fmt.Print("\r\033[K")
+	}
+}
+
+func (p *progress) drawStatus() {
+	if p.tty && p.showStatus {
+		fmt.Print("\r\033[K" + p.status())
+	}
+}
+
+// status describes the progress so far, naming the first few outstanding devices
+func (p *progress) status() string {
+	var outstanding []string
+	for _, t := range p.targets {
+		if !p.returned[t.MinionID] {
+			outstanding = append(outstanding, t.Label())
+		}
+	}
+	status := fmt.Sprintf("%v/%v returned, %v failed, %v did not respond, %v", len(p.returned), len(p.targets),
+		p.failed, p.noResponse, time.Since(p.start).Round(time.Second))
+	if len(outstanding) == 0 {
+		return status
+	}
+	shown := outstanding
+	if len(shown) > progressNamesShown {
+		shown = shown[:progressNamesShown]
+	}
+	status += ", waiting on " + strings.Join(shown, ", ")
+	if len(outstanding) > len(shown) {
+		status += fmt.Sprintf(" and %v more", len(outstanding)-len(shown))
+	}
+	return status
+}
@@ -0,0 +1,492 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const (
+	statusOK         = "ok"
+	statusFailed     = "failed"
+	statusNoResponse = "no-response"
+
+	defaultChunkSize = 500
+	// maxTargetArgLen keeps the -L argument well below the kernel's 128KiB single argument limit
+	maxTargetArgLen = 64 * 1024
+	// maxSaltLine is the longest line of salt output csalt can decode
+	maxSaltLine = 64 * 1024 * 1024
+)
+
+// target is a translated device and its salt minion id
+type target struct {
+	Device   userapi.Device
+	MinionID string
+}
+
+// Label returns the friendly name of the target, or its minion id if the device is unknown
+func (t target) Label() string {
+	if t.Device.DeviceName == "" {
+		return t.MinionID
+	}
+	return deviceLabel(t.Device)
+}
+
+// newTargets returns the targets for devices on server
+func newTargets(server *userapi.Server, devices []userapi.Device) []target {
+	idPrefix := getSaltPrefix(server.Url, server.SaltPrefix)
+	targets := make([]target, len(devices))
+	for i, device := range devices {
+		targets[i] = target{Device: device, MinionID: minionID(idPrefix, device)}
+	}
+	return targets
+}
+
+func targetIDs(targets []target) []string {
+	ids := make([]string, len(targets))
+	for i, t := range targets {
+		ids[i] = t.MinionID
+	}
+	return ids
+}
+
+func targetDevices(targets []target) []userapi.Device {
+	devices := make([]userapi.Device, len(targets))
+	for i, t := range targets {
+		devices[i] = t.Device
+	}
+	return devices
+}
+
+// minionResult is the return of a single device from a salt run
+type minionResult struct {
+	target
+	Status string
+	Return json.RawMessage
+}
+
+// runResult is the aggregated results of one or more salt runs
+type runResult struct {
+	JIDs    []string
+	Results []minionResult
+	// Skipped are the targets salt was not run on
+	Skipped []target
+}
+
+func (r *runResult) add(other *runResult) {
+	r.JIDs = append(r.JIDs, other.JIDs...)
+	r.Results = append(r.Results, other.Results...)
+	r.Skipped = append(r.Skipped, other.Skipped...)
+}
+
+// Failures returns the number of devices that failed or did not respond
+func (r *runResult) Failures() int {
+	return len(r.Results) - r.Count(statusOK)
+}
+
+// Count returns the number of devices with status
+func (r *runResult) Count(status string) int {
+	count := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Unsuccessful returns the results of the devices that failed or did not respond
+func (r *runResult) Unsuccessful() *runResult {
+	unsuccessful := &runResult{JIDs: r.JIDs}
+	for _, result := range r.Results {
+		if result.Status != statusOK {
+			unsuccessful.Results = append(unsuccessful.Results, result)
+		}
+	}
+	return unsuccessful
+}
+
+// Targets returns the targets with status
+func (r *runResult) Targets(status string) []target {
+	var targets []target
+	for _, result := range r.Results {
+		if result.Status == status {
+			targets = append(targets, result.target)
+		}
+	}
+	return targets
+}
+
+// saltFunction returns the salt function in argCommands e.g. state.apply
+func saltFunction(argCommands []string) string {
+	for _, arg := range argCommands {
+		if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+			return arg
+		}
+	}
+	return ""
+}
+
+// saltErrorPatterns match the returns salt gives in place of a function's output when it couldn't
+// run the function. They must match from the start so command output isn't mistaken for an error
+var saltErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^'[^']+' is not available\.$`),
+	regexp.MustCompile(`^The minion function caused an exception`),
+	regexp.MustCompile(`^Passed invalid arguments`),
+	regexp.MustCompile(`^ERROR executing '[^']+': `),
+}
+
+// classifyReturn decides whether a minion's return for fun succeeded
+func classifyReturn(fun string, ret json.RawMessage) string {
+	var value interface{}
+	if err := json.Unmarshal(ret, &value); err != nil {
+		return statusFailed
+	}
+	switch v := value.(type) {
+	case string:
+		if strings.HasPrefix(v, "Minion did not return") {
+			return statusNoResponse
+		}
+		for _, pattern := range saltErrorPatterns {
+			if pattern.MatchString(v) {
+				return statusFailed
+			}
+		}
+	case bool:
+		if fun == "test.ping" && !v {
+			return statusFailed
+		}
+	case []interface{}:
+		// state functions return a list of errors when the states fail to compile
+		if strings.HasPrefix(fun, "state.") {
+			return statusFailed
+		}
+	case map[string]interface{}:
+		for _, state := range v {
+			if stateRet, ok := state.(map[string]interface{}); ok {
+				if result, ok := stateRet["result"].(bool); ok && !result {
+					return statusFailed
+				}
+			}
+		}
+	}
+	return statusOK
+}
+
+// collectSalt runs argCommands on targets with json output, calling onResult as each return
+// arrives. Targets that don't return are reported as no-response
+func collectSalt(targets []target, argCommands []string, onResult func(minionResult)) (*runResult, error) {
+	byID := make(map[string]target, len(targets))
+	for _, t := range targets {
+		byID[t.MinionID] = t
+	}
+	fun := saltFunction(argCommands)
+	result := &runResult{}
+	returned := make(map[string]bool)
+	addResult := func(minion string, ret json.RawMessage) {
+		t, ok := byID[minion]
+		if !ok || returned[minion] {
+			return
+		}
+		returned[minion] = true
+		res := minionResult{target: t, Status: classifyReturn(fun, ret), Return: ret}
+		result.Results = append(result.Results, res)
+		if onResult != nil {
+			onResult(res)
+		}
+	}
+
+	commands := []string{"--out=json", "--show-jid", "-L", strings.Join(targetIDs(targets), " ")}
+	commands = append(commands, argCommands...)
+	reader, writer := io.Pipe()
+	done := make(chan error)
+	go func() {
+		jid, err := decodeSaltStream(reader, addResult)
+		if jid != "" {
+			result.JIDs = append(result.JIDs, jid)
+		}
+		io.Copy(ioutil.Discard, reader)
+		done <- err
+	}()
+	runErr := saltExec.Run(&saltCmd{binary: "salt", args: commands, stdout: writer, stderr: os.Stderr})
+	writer.Close()
+	decodeErr := <-done
+
+	if len(result.Results) == 0 {
+		if runErr != nil {
+			return nil, runErr
+		}
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+	}
+	noResponse, _ := json.Marshal(noResponseReturn)
+	for _, t := range targets {
+		addResult(t.MinionID, noResponse)
+	}
+	return result, nil
+}
+
+// lookupJob fetches the returns of job jid from the salt master job cache
+func lookupJob(jid string) (map[string]json.RawMessage, error) {
+	output, err := getSaltBinaryOutput("salt-run", "--out=json", "jobs.lookup_jid", jid)
+	if err != nil {
+		return nil, err
+	}
+	returns := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(output), &returns); err != nil {
+		return nil, fmt.Errorf("Error decoding job %v %v", jid, err)
+	}
+	return returns, nil
+}
+
+// jobMinions returns the minions salt sent job jid to
+func jobMinions(jid string) ([]string, error) {
+	output, err := getSaltBinaryOutput("salt-run", "--out=json", "jobs.list_job", jid)
+	if err != nil {
+		return nil, err
+	}
+	var job struct {
+		Minions []string `json:"Minions"`
+	}
+	if err := json.Unmarshal([]byte(output), &job); err != nil {
+		return nil, fmt.Errorf("Error decoding job %v %v", jid, err)
+	}
+	return job.Minions, nil
+}
+
+// newJobResult classifies the returns of job jid, targets missing from returns did not respond
+func newJobResult(targets []target, jid string, argCommands []string, returns map[string]json.RawMessage) *runResult {
+	fun := saltFunction(argCommands)
+	result := &runResult{JIDs: []string{jid}}
+	noResponse, _ := json.Marshal(noResponseReturn)
+	for _, t := range targets {
+		ret, ok := returns[t.MinionID]
+		if !ok {
+			ret = noResponse
+		}
+		result.Results = append(result.Results, minionResult{target: t, Status: classifyReturn(fun, ret), Return: ret})
+	}
+	return result
+}
+
+// decodeSaltStream reads salt's json output, one object of minion returns at a time. The jid
+// line from --show-jid is returned and other text lines are passed to stderr
+func decodeSaltStream(r io.Reader, onReturn func(minion string, ret json.RawMessage)) (string, error) {
+	var jid string
+	var object []byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxSaltLine)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if object == nil && !strings.HasPrefix(line, "{") {
+			if strings.HasPrefix(line, "jid: ") {
+				jid = strings.TrimSpace(strings.TrimPrefix(line, "jid: "))
+			} else if strings.TrimSpace(line) != "" {
+				fmt.Fprintln(os.Stderr, line)
+			}
+			continue
+		}
+		object = append(object, line...)
+		object = append(object, '\n')
+		// each object's closing brace is the only unindented } so only try to decode there
+		if !strings.HasPrefix(line, "}") && !(strings.HasPrefix(line, "{") && strings.HasSuffix(line, "}")) {
+			continue
+		}
+		var returns map[string]json.RawMessage
+		if err := json.Unmarshal(object, &returns); err != nil {
+			if strings.HasPrefix(line, "}") {
+				return jid, fmt.Errorf("Error decoding salt output %v", err)
+			}
+			continue
+		}
+		object = nil
+		for _, minion := range sortedKeys(returns) {
+			onReturn(minion, returns[minion])
+		}
+	}
+	return jid, scanner.Err()
+}
+
+// printMinionResult prints a device's return labelled with its friendly name
+func printMinionResult(res minionResult) {
+	fmt.Printf("%v (%v):\n", res.Label(), res.MinionID)
+	writeYAML(os.Stdout, res.Return, "    ")
+}
+
+// printRunSummary prints the totals of a run and the devices that failed or didn't respond
+func printRunSummary(result *runResult) {
+	fmt.Printf("\n%v devices: %v succeeded, %v failed, %v did not respond\n", len(result.Results),
+		result.Count(statusOK), result.Count(statusFailed), result.Count(statusNoResponse))
+	for _, status := range []string{statusFailed, statusNoResponse} {
+		printTargets(status+":", result.Targets(status))
+	}
+	printTargets(fmt.Sprintf("not run on %v devices:", len(result.Skipped)), result.Skipped)
+}
+
+// printTargets prints heading followed by the friendly name of each target, if there are any
+func printTargets(heading string, targets []target) {
+	if len(targets) == 0 {
+		return
+	}
+	fmt.Println(heading)
+	for _, t := range targets {
+		fmt.Printf("  %v (%v)\n", t.Label(), t.MinionID)
+	}
+}
+
+// runError returns an error if any device in result failed, did not respond or was not run
+func runError(result *runResult) error {
+	if failed := result.Failures(); failed > 0 {
+		return fmt.Errorf("%v of %v devices failed or did not respond", failed, len(result.Results))
+	}
+	if len(result.Skipped) > 0 {
+		return fmt.Errorf("%v devices were not run", len(result.Skipped))
+	}
+	return nil
+}
+
+// BatchSize is the number of devices, or percentage of devices when Percent is set, per batch
+type BatchSize struct {
+	Value   int
+	Percent bool
+}
+
+// UnmarshalText is called by go-arg to parse --batch values such as 10 or 10%
+func (b *BatchSize) UnmarshalText(text []byte) error {
+	value := strings.TrimSpace(string(text))
+	b.Percent = strings.HasSuffix(value, "%")
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || n < 1 || (b.Percent && n > 100) {
+		return fmt.Errorf("invalid batch size %v, expected a number of devices or a percentage", value)
+	}
+	b.Value = n
+	return nil
+}
+
+func (b BatchSize) IsSet() bool {
+	return b.Value > 0
+}
+
+// Size returns the number of devices in each batch of total devices, always at least 1
+func (b BatchSize) Size(total int) int {
+	if !b.Percent {
+		return b.Value
+	}
+	size := (total*b.Value + 99) / 100
+	if size < 1 {
+		return 1
+	}
+	return size
+}
+
+// needsChunking returns true if the targets are too many for a single salt command
+func needsChunking(targets []target, chunkSize int) bool {
+	return len(targets) > chunkSize || len(strings.Join(targetIDs(targets), " ")) > maxTargetArgLen
+}
+
+// chunkTargets splits targets into chunks of at most size targets and maxTargetArgLen characters
+func chunkTargets(targets []target, size int) [][]target {
+	var chunks [][]target
+	start, length := 0, 0
+	for i, t := range targets {
+		if i > start && (i-start >= size || length+len(t.MinionID)+1 > maxTargetArgLen) {
+			chunks = append(chunks, targets[start:i])
+			start, length = i, 0
+		}
+		length += len(t.MinionID) + 1
+	}
+	if start < len(targets) {
+		chunks = append(chunks, targets[start:])
+	}
+	return chunks
+}
+
+// batchOptions controls how runBatches splits and reports a run
+type batchOptions struct {
+	// size is the number of devices in each batch
+	size int
+	// name describes a batch in progress messages e.g. chunk
+	name string
+	// maxFailures stops the run once more devices have failed, a negative value never stops
+	maxFailures int
+	// quiet doesn't print each device's return
+	quiet bool
+	// progress shows the status line while salt runs, it is always shown when there are several batches
+	progress bool
+	// perDevice runs separate salt commands for each device when required
+	perDevice perDevice
+}
+
+// runBatches runs argCommands on targets one batch at a time, reporting progress after each batch
+// and stopping once more than maxFailures devices have failed
+func runBatches(targets []target, argCommands []string, opts batchOptions) (*runResult, error) {
+	batches := chunkTargets(targets, opts.size)
+	total := &runResult{}
+	for i, batch := range batches {
+		if len(batches) > 1 {
+			fmt.Printf("Running %v %v/%v (%v devices)\n", opts.name, i+1, len(batches), len(batch))
+		}
+		progress := startProgress(batch, !opts.quiet, opts.progress || len(batches) > 1)
+		result, err := collectTargets(batch, argCommands, progress.Result, opts.perDevice)
+		progress.Stop()
+		if err != nil {
+			return total, err
+		}
+		total.add(result)
+		failures := total.Failures()
+		if len(batches) > 1 {
+			fmt.Printf("%v %v/%v, %v failures\n", opts.name, i+1, len(batches), failures)
+		}
+		if opts.maxFailures >= 0 && failures > opts.maxFailures && i+1 < len(batches) {
+			fmt.Printf("Stopping, %v failures is more than --max-failures %v\n", failures, opts.maxFailures)
+			for _, rest := range batches[i+1:] {
+				total.Skipped = append(total.Skipped, rest...)
+			}
+			break
+		}
+	}
+	printRunSummary(total)
+	return total, nil
+}
+
+// writeYAML writes json data as indented yaml
+func writeYAML(w io.Writer, data json.RawMessage, indent string) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	buf, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(buf), "\n"), "\n") {
+		fmt.Fprintf(w, "%v%v\n", indent, line)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// useFakeExecutor replaces saltExec with a fake replying with responses, the returned func
+// restores the previous executor
+func useFakeExecutor(responses ...fakeResponse) func() {
+	previous := saltExec
+	saltExec = &fakeExecutor{responses: responses}
+	return func() { saltExec = previous }
+}
+
+// testTargets returns n targets in group g named cam1 to camN with minion ids pi-1 to pi-N
+func testTargets(n int) []target {
+	targets := make([]target, n)
+	for i := range targets {
+		device := userapi.Device{GroupName: "g", DeviceName: "cam" + strconv.Itoa(i+1), SaltId: i + 1}
+		targets[i] = target{Device: device, MinionID: "pi-" + strconv.Itoa(i+1)}
+	}
+	return targets
+}
+
+// statuses maps the minion ids in result to their status
+func statuses(result *runResult) map[string]string {
+	byID := make(map[string]string, len(result.Results))
+	for _, res := range result.Results {
+		byID[res.MinionID] = res.Status
+	}
+	return byID
+}
+
+func TestClassifyReturn(t *testing.T) {
+	tests := []struct {
+		fun    string
+		ret    interface{}
+		status string
+	}{
+		{"test.ping", true, statusOK},
+		{"test.ping", false, statusFailed},
+		{"test.ping", "Minion did not return. [No response]", statusNoResponse},
+		{"cmd.run", "service is not available", statusOK},
+		{"cmd.run", "ERROR: disk almost full", statusOK},
+		{"cmd.run", "line one\n'foo.bar' is not available.", statusOK},
+		{"foo.bar", "'foo.bar' is not available.", statusFailed},
+		{"cmd.run", "The minion function caused an exception: Traceback ...", statusFailed},
+		{"cmd.run", "Passed invalid arguments to cmd.run: missing cmd", statusFailed},
+		{"pkg.install", "ERROR executing 'pkg.install': no such package", statusFailed},
+		{"state.apply", []string{"Rendering SLS 'base:foo' failed"}, statusFailed},
+		{"state.apply", map[string]interface{}{"pkg_|-a_|-a_|-installed": map[string]interface{}{"result": true}}, statusOK},
+		{"state.apply", map[string]interface{}{"pkg_|-a_|-a_|-installed": map[string]interface{}{"result": false}}, statusFailed},
+	}
+	for _, test := range tests {
+		ret, _ := json.Marshal(test.ret)
+		if status := classifyReturn(test.fun, ret); status != test.status {
+			t.Errorf("classifyReturn(%q, %s) = %v, want %v", test.fun, ret, status, test.status)
+		}
+	}
+}
+
+func TestNewFakeExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csalt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "fake.yaml")
+	err = ioutil.WriteFile(script, []byte(`
+- command: "salt --out=json --show-jid -L * test.ping"
+  stdout: "jid: 1\n{\n    \"pi-1\": true\n}\n"
+- command: "salt-key *"
+  exit: 2
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newFakeExecutor(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout strings.Builder
+	if err := e.Run(&saltCmd{binary: "salt", args: []string{"--out=json", "--show-jid", "-L", "pi-1 pi-2", "test.ping"}, stdout: &stdout}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "jid: 1\n{\n    \"pi-1\": true\n}\n" {
+		t.Errorf("unexpected stdout %q", stdout.String())
+	}
+	if err := e.Run(&saltCmd{binary: "salt-key", args: []string{"-L"}}); err == nil {
+		t.Error("expected an error for a non zero exit")
+	}
+	if err := e.Run(&saltCmd{binary: "salt-run", args: []string{"jobs.list_jobs"}}); err == nil {
+		t.Error("expected an error for an unscripted command")
+	}
+}
+
+func TestDecodeSaltStream(t *testing.T) {
+	output := "jid: 20261018000001\n" +
+		"{\n    \"pi-1\": {\n        \"a\": \"}\"\n    }\n}\n" +
+		"some warning\n" +
+		"{\"pi-2\": true}\n"
+	returns := make(map[string]string)
+	jid, err := decodeSaltStream(strings.NewReader(output), func(minion string, ret json.RawMessage) {
+		var value interface{}
+		json.Unmarshal(ret, &value)
+		buf, _ := json.Marshal(value)
+		returns[minion] = string(buf)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jid != "20261018000001" {
+		t.Errorf("jid = %q", jid)
+	}
+	want := map[string]string{"pi-1": `{"a":"}"}`, "pi-2": "true"}
+	if !reflect.DeepEqual(returns, want) {
+		t.Errorf("returns = %v, want %v", returns, want)
+	}
+}
+
+func TestCollectSaltNoResponse(t *testing.T) {
+	defer useFakeExecutor(fakeResponse{
+		Command: "salt --out=json --show-jid -L pi-1 pi-2 pi-3 test.ping",
+		Stdout:  "jid: 7\n{\n    \"pi-1\": true\n}\n{\n    \"pi-3\": false\n}\n",
+	})()
+	var streamed []string
+	result, err := collectSalt(testTargets(3), []string{"test.ping"}, func(res minionResult) {
+		streamed = append(streamed, res.MinionID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"pi-1": statusOK, "pi-2": statusNoResponse, "pi-3": statusFailed}
+	if got := statuses(result); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(result.JIDs, []string{"7"}) {
+		t.Errorf("JIDs = %v", result.JIDs)
+	}
+	if len(streamed) != 3 {
+		t.Errorf("onResult called for %v, want every target", streamed)
+	}
+}
+
+func TestCollectSaltError(t *testing.T) {
+	defer useFakeExecutor(fakeResponse{Command: "salt *", Stderr: "No minions matched\n", Exit: 1})()
+	if _, err := collectSalt(testTargets(2), []string{"test.ping"}, nil); err == nil {
+		t.Error("expected an error when salt fails without returns")
+	}
+}
+
+func TestRunBatchesChunks(t *testing.T) {
+	defer useFakeExecutor(
+		fakeResponse{Command: "salt --out=json --show-jid -L pi-1 pi-2 test.ping", Stdout: "jid: 1\n{\"pi-1\": true}\n{\"pi-2\": true}\n"},
+		fakeResponse{Command: "salt --out=json --show-jid -L pi-3 pi-4 test.ping", Stdout: "jid: 2\n{\"pi-3\": true}\n"},
+		fakeResponse{Command: "salt --out=json --show-jid -L pi-5 test.ping", Stdout: "jid: 3\n{\"pi-5\": true}\n"},
+	)()
+	result, err := runBatches(testTargets(5), []string{"test.ping"}, batchOptions{size: 2, name: "chunk", maxFailures: -1, quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.JIDs, []string{"1", "2", "3"}) {
+		t.Errorf("JIDs = %v, want a job per chunk", result.JIDs)
+	}
+	want := map[string]string{"pi-1": statusOK, "pi-2": statusOK, "pi-3": statusOK, "pi-4": statusNoResponse, "pi-5": statusOK}
+	if got := statuses(result); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if result.Failures() != 1 || len(result.Skipped) != 0 {
+		t.Errorf("failures = %v skipped = %v", result.Failures(), result.Skipped)
+	}
+}
+
+func TestRunBatchesMaxFailures(t *testing.T) {
+	// later batches have no scripted response so running them would fail the test
+	defer useFakeExecutor(
+		fakeResponse{Command: "salt --out=json --show-jid -L pi-1 pi-2 test.ping", Stdout: "jid: 1\n{\"pi-1\": true}\n{\"pi-2\": false}\n"},
+		fakeResponse{Command: "salt --out=json --show-jid -L pi-3 pi-4 test.ping", Stdout: "jid: 2\n{\"pi-3\": true}\n"},
+	)()
+	result, err := runBatches(testTargets(6), []string{"test.ping"}, batchOptions{size: 2, name: "batch", maxFailures: 1, quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failures() != 2 {
+		t.Errorf("failures = %v, want 2", result.Failures())
+	}
+	if got := targetIDs(result.Skipped); !reflect.DeepEqual(got, []string{"pi-5", "pi-6"}) {
+		t.Errorf("skipped = %v, want pi-5 and pi-6", got)
+	}
+	if runError(result) == nil {
+		t.Error("expected runError to report the failures")
+	}
+}
@@ -0,0 +1,148 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// runLogFile is the append only log of every salt command csalt runs, one json object per line
+const runLogFile = "audit.log"
+
+// runLogEntry records who ran a salt command on which devices and how it finished
+type runLogEntry struct {
+	Time       string   `json:"time" yaml:"time"`
+	LocalUser  string   `json:"localUser" yaml:"localUser"`
+	APIUser    string   `json:"apiUser,omitempty" yaml:"apiUser,omitempty"`
+	Server     string   `json:"server,omitempty" yaml:"server,omitempty"`
+	DeviceInfo string   `json:"deviceInfo,omitempty" yaml:"deviceInfo,omitempty"`
+	Devices    []string `json:"devices,omitempty" yaml:"devices,omitempty"`
+	MinionIDs  []string `json:"minionIds,omitempty" yaml:"minionIds,omitempty"`
+	Binary     string   `json:"binary" yaml:"binary"`
+	Args       []string `json:"args" yaml:"args"`
+	Exit       int      `json:"exit" yaml:"exit"`
+	Error      string   `json:"error,omitempty" yaml:"error,omitempty"`
+	JIDs       []string `json:"jids,omitempty" yaml:"jids,omitempty"`
+}
+
+// newRunLogEntry starts an entry for running binary with args on server
+func newRunLogEntry(server *userapi.Server, binary string, args []string) *runLogEntry {
+	entry := &runLogEntry{
+		Time:   time.Now().Format(time.RFC3339),
+		Binary: binary,
+		Args:   args,
+	}
+	if usr, err := user.Current(); err == nil {
+		entry.LocalUser = usr.Username
+	}
+	if server != nil {
+		entry.APIUser = server.UserName
+		entry.Server = server.Url
+	}
+	return entry
+}
+
+// SetTargets records the DEVICEINFO and the devices it resolved to
+func (e *runLogEntry) SetTargets(deviceInfo string, targets []target) {
+	e.DeviceInfo = deviceInfo
+	e.Devices = make([]string, len(targets))
+	for i, t := range targets {
+		e.Devices[i] = t.Label()
+	}
+	e.MinionIDs = targetIDs(targets)
+}
+
+// Finish records the outcome of the command and appends the entry to the run log. Failing to
+// write the log is reported but doesn't fail the command
+func (e *runLogEntry) Finish(jids []string, runErr error) {
+	e.JIDs = jids
+	if runErr != nil {
+		e.Exit = 1
+		if exitErr, ok := runErr.(*exec.ExitError); ok {
+			e.Exit = exitErr.ExitCode()
+		}
+		e.Error = runErr.Error()
+	}
+	if err := appendRunLog(e); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing run log %v\n", err)
+	}
+}
+
+// readRunLog returns every entry in the run log, oldest first
+func readRunLog() ([]runLogEntry, error) {
+	filePath, err := statePath(runLogFile)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := userapi.NewLockSafeConfig(filePath).Read()
+	if err != nil {
+		return nil, err
+	}
+	var entries []runLogEntry
+	for i, line := range strings.Split(string(buf), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry runLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("Error parsing %v line %v: %v", runLogFile, i+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Targets returns the devices the entry ran on
+func (e *runLogEntry) Targets() []target {
+	targets := make([]target, len(e.MinionIDs))
+	for i, id := range e.MinionIDs {
+		targets[i].MinionID = id
+		if i < len(e.Devices) {
+			parts := strings.SplitN(e.Devices[i], ":", 2)
+			if len(parts) == 2 {
+				targets[i].Device = userapi.Device{GroupName: parts[0], DeviceName: parts[1]}
+			}
+		}
+	}
+	return targets
+}
+
+// appendRunLog appends entry to the run log holding an exclusive lock so concurrent csalt
+// runs don't interleave their lines
+func appendRunLog(entry *runLogEntry) error {
+	filePath, err := statePath(runLogFile)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	lockSafeConfig := userapi.NewLockSafeConfig(filePath)
+	if _, err := lockSafeConfig.ExLock(); err != nil {
+		return err
+	}
+	defer lockSafeConfig.Unlock()
+	return lockSafeConfig.Append(append(buf, '\n'))
+}
@@ -0,0 +1,592 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/howeyc/gopass"
+	"gopkg.in/yaml.v1"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const (
+	executorSaltAPI = "salt-api"
+
+	saltAPITokenFile    = "salt-api-token.yaml"
+	saltAPIDefaultEAuth = "pam"
+	saltAPITimeout      = 60 * time.Second
+	saltAPIPollInterval = time.Second
+	saltAPIDefaultWait  = 60 * time.Second
+)
+
+// errSaltAPIUnauthorized is returned when salt-api rejects the login or token
+var errSaltAPIUnauthorized = errors.New("salt-api authentication failed")
+
+// saltTargetTypes maps salt targeting options to salt-api tgt_type
+var saltTargetTypes = map[string]string{
+	"-L": "list", "--list": "list",
+	"-G": "grain", "--grain": "grain",
+	"-E": "pcre", "--pcre": "pcre",
+	"-C": "compound", "--compound": "compound",
+	"-N": "nodegroup", "--nodegroup": "nodegroup",
+}
+
+// saltInvocation is a salt command line parsed for the salt-api
+type saltInvocation struct {
+	tgtType string
+	tgt     interface{}
+	fun     string
+	args    []interface{}
+	kwargs  map[string]interface{}
+	out     string
+	static  bool
+	showJID bool
+	async   bool
+	timeout time.Duration
+}
+
+// integerPattern matches a whole number
+var integerPattern = regexp.MustCompile(`^[-+]?[0-9]+$`)
+
+// parseSaltValue converts a command line value to yaml data as the salt cli does e.g. True to true
+func parseSaltValue(value string) interface{} {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(value), &parsed); err != nil || parsed == nil {
+		return value
+	}
+	switch parsed.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		// salt-api passes kwargs to the minion as they are, so nested values such as inline
+		// pillar must be sent as data rather than a string
+		return jsonValue(parsed)
+	case float64:
+		// integers too big for an int64, such as jids, are parsed as floats which loses digits
+		if integerPattern.MatchString(value) {
+			return value
+		}
+	}
+	return parsed
+}
+
+// jsonValue converts the maps of parsed yaml, which have interface{} keys, to maps that can be
+// encoded as json
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = jsonValue(item)
+		}
+		return converted
+	}
+	return value
+}
+
+// parseSaltArgs parses the arguments of salt or salt-run for the salt-api
+func parseSaltArgs(binary string, args []string) (*saltInvocation, error) {
+	inv := &saltInvocation{tgtType: "glob", kwargs: make(map[string]interface{}), timeout: saltAPIDefaultWait}
+	var positionals []string
+	allPositional := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" && !allPositional {
+			allPositional = true
+			continue
+		}
+		if allPositional || !strings.HasPrefix(arg, "-") || arg == "-" {
+			positionals = append(positionals, arg)
+			continue
+		}
+		name, value := arg, ""
+		hasValue := false
+		if pos := strings.Index(arg, "="); pos > 0 {
+			name, value, hasValue = arg[:pos], arg[pos+1:], true
+		}
+		nextValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing value for %v", name)
+			}
+			i++
+			return args[i], nil
+		}
+		if tgtType, ok := saltTargetTypes[name]; ok {
+			inv.tgtType = tgtType
+			continue
+		}
+		switch name {
+		case "--out":
+			out, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			inv.out = out
+		case "-t", "--timeout":
+			timeout, err := nextValue()
+			if err != nil {
+				return nil, err
+			}
+			seconds, err := strconv.Atoi(timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout %v", timeout)
+			}
+			inv.timeout = time.Duration(seconds) * time.Second
+		case "--static":
+			inv.static = true
+		case "--show-jid":
+			inv.showJID = true
+		case "--async":
+			inv.async = true
+		default:
+			return nil, fmt.Errorf("%v is not supported by the salt-api executor", name)
+		}
+	}
+
+	if binary == "salt" {
+		if len(positionals) < 2 {
+			return nil, errors.New("salt requires a target and a function")
+		}
+		inv.tgt = positionals[0]
+		if inv.tgtType == "list" {
+			inv.tgt = strings.FieldsFunc(positionals[0], func(r rune) bool { return r == ',' || r == ' ' })
+		}
+		positionals = positionals[1:]
+	}
+	if len(positionals) == 0 {
+		return nil, fmt.Errorf("%v requires a function", binary)
+	}
+	inv.fun = positionals[0]
+	for _, arg := range positionals[1:] {
+		if pos := strings.Index(arg, "="); pos > 0 {
+			inv.kwargs[arg[:pos]] = parseSaltValue(arg[pos+1:])
+		} else {
+			inv.args = append(inv.args, parseSaltValue(arg))
+		}
+	}
+	return inv, nil
+}
+
+// saltAPIToken is a salt-api session token saved between runs
+type saltAPIToken struct {
+	URL      string  `yaml:"url"`
+	UserName string  `yaml:"user-name"`
+	Token    string  `yaml:"token"`
+	Expire   float64 `yaml:"expire"`
+}
+
+// saltAPIExecutor runs salt and salt-run through the salt-api rest_cherrypy interface
+type saltAPIExecutor struct {
+	conf       userapi.SaltAPI
+	httpClient *http.Client
+	// password prompts for the salt-api password when there is no saved token
+	password  func() ([]byte, error)
+	mu        sync.Mutex
+	token     string
+	warnFiles sync.Once
+}
+
+func newSaltAPIExecutor(conf *userapi.SaltAPI) (*saltAPIExecutor, error) {
+	if conf == nil || conf.Url == "" {
+		return nil, errors.New("salt-api executor requires a salt-api url")
+	}
+	e := &saltAPIExecutor{
+		conf:       *conf,
+		httpClient: &http.Client{Timeout: saltAPITimeout},
+		password:   gopass.GetPasswd,
+	}
+	if e.conf.EAuth == "" {
+		e.conf.EAuth = saltAPIDefaultEAuth
+	}
+	return e, nil
+}
+
+// ReadFile reports every file as missing, the salt master files are not available over the salt-api.
+// A warning is printed once as nodegroups can't be read without them
+func (e *saltAPIExecutor) ReadFile(file string) ([]byte, error) {
+	e.warnFiles.Do(func() {
+		fmt.Fprintln(os.Stderr, "Warning: the salt-api executor can't read the salt master files so nodegroups "+
+			"are unknown, every device will be shown as stale and without a nodegroup")
+	})
+	if debug {
+		fmt.Fprintf(os.Stderr, "salt-api can't read %v\n", file)
+	}
+	return nil, &os.PathError{Op: "open", Path: file, Err: os.ErrNotExist}
+}
+
+func (e *saltAPIExecutor) Glob(pattern string) ([]string, error) {
+	return nil, nil
+}
+
+// login returns a salt-api token, reusing the saved token until it expires
+func (e *saltAPIExecutor) login() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" {
+		return e.token, nil
+	}
+	var saved saltAPIToken
+	if err := readStateFile(saltAPITokenFile, &saved); err != nil && debug {
+		fmt.Fprintf(os.Stderr, "Error reading salt-api token %v\n", err)
+	}
+	if saved.URL == e.conf.Url && saved.UserName == e.conf.UserName &&
+		saved.Expire > float64(time.Now().Unix()) {
+		e.token = saved.Token
+		return e.token, nil
+	}
+
+	fmt.Printf("salt-api authentication is required for %v\n", e.conf.UserName)
+	fmt.Print("Enter Password: ")
+	password, err := e.password()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]string{
+		"username": e.conf.UserName,
+		"password": string(password),
+		"eauth":    e.conf.EAuth,
+	})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Return []saltAPIToken `json:"return"`
+	}
+	if err := e.post("/login", "", payload, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Return) == 0 || resp.Return[0].Token == "" {
+		return "", errors.New("salt-api login returned no token")
+	}
+	saved = resp.Return[0]
+	saved.URL = e.conf.Url
+	saved.UserName = e.conf.UserName
+	if err := writeStateFile(saltAPITokenFile, &saved); err != nil && debug {
+		fmt.Fprintf(os.Stderr, "Error saving salt-api token %v\n", err)
+	}
+	e.token = saved.Token
+	return e.token, nil
+}
+
+func (e *saltAPIExecutor) do(req *http.Request, token string, result interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "salt-api %v %v\n", req.Method, req.URL)
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errSaltAPIUnauthorized
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("salt-api request failed (%d): %s", resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decode: %v", err)
+	}
+	return nil
+}
+
+func (e *saltAPIExecutor) post(path, token string, payload []byte, result interface{}) error {
+	req, err := http.NewRequest("POST", joinPath(e.conf.Url, path), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return e.do(req, token, result)
+}
+
+// prepareConcurrent logs in so concurrent requests share the token
+func (e *saltAPIExecutor) prepareConcurrent() error {
+	_, err := e.login()
+	return err
+}
+
+// authorized calls request with the login token, logging in again once if salt-api rejects a
+// token that has been revoked or has expired early
+func (e *saltAPIExecutor) authorized(request func(token string) error) error {
+	token, err := e.login()
+	if err != nil {
+		return err
+	}
+	if err := request(token); err != errSaltAPIUnauthorized {
+		return err
+	}
+	e.forgetToken(token)
+	if token, err = e.login(); err != nil {
+		return err
+	}
+	return request(token)
+}
+
+// forgetToken removes a rejected token from memory and from the saved token file so later runs
+// don't reuse it
+func (e *saltAPIExecutor) forgetToken(token string) {
+	e.mu.Lock()
+	if e.token == token {
+		e.token = ""
+	}
+	e.mu.Unlock()
+	var saved saltAPIToken
+	err := updateStateFile(saltAPITokenFile, &saved, func() error {
+		if saved.Token == token {
+			saved = saltAPIToken{}
+		}
+		return nil
+	})
+	if err != nil && debug {
+		fmt.Fprintf(os.Stderr, "Error removing salt-api token %v\n", err)
+	}
+}
+
+// lowstate submits a single salt-api lowstate chunk and decodes the first return into result
+func (e *saltAPIExecutor) lowstate(chunk map[string]interface{}, result interface{}) error {
+	payload, err := json.Marshal([]map[string]interface{}{chunk})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Return []json.RawMessage `json:"return"`
+	}
+	err = e.authorized(func(token string) error {
+		return e.post("/", token, payload, &resp)
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Return) == 0 {
+		return errors.New("salt-api returned no result")
+	}
+	return json.Unmarshal(resp.Return[0], result)
+}
+
+// jobReturns fetches the minions targeted by jid and the returns received so far
+func (e *saltAPIExecutor) jobReturns(jid string) ([]string, map[string]json.RawMessage, error) {
+	var resp struct {
+		Info []struct {
+			Minions []string `json:"Minions"`
+		} `json:"info"`
+		Return []map[string]json.RawMessage `json:"return"`
+	}
+	err := e.authorized(func(token string) error {
+		req, err := http.NewRequest("GET", joinPath(e.conf.Url, "/jobs/"+jid), nil)
+		if err != nil {
+			return err
+		}
+		return e.do(req, token, &resp)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var minions []string
+	if len(resp.Info) > 0 {
+		minions = resp.Info[0].Minions
+	}
+	returns := make(map[string]json.RawMessage)
+	if len(resp.Return) > 0 {
+		returns = resp.Return[0]
+	}
+	return minions, returns, nil
+}
+
+func (e *saltAPIExecutor) Run(cmd *saltCmd) error {
+	if debug {
+		fmt.Fprintf(os.Stderr, "salt-api %v\n", cmd)
+	}
+	switch cmd.binary {
+	case "salt":
+		inv, err := parseSaltArgs(cmd.binary, cmd.args)
+		if err != nil {
+			return err
+		}
+		return e.runLocal(inv, cmd.stdout)
+	case "salt-run":
+		inv, err := parseSaltArgs(cmd.binary, cmd.args)
+		if err != nil {
+			return err
+		}
+		return e.runRunner(inv, cmd.stdout)
+	}
+	return fmt.Errorf("%v is not supported by the salt-api executor", cmd.binary)
+}
+
+// runLocal submits a job to the targeted minions and polls for returns until every minion has
+// returned or the timeout passes
+func (e *saltAPIExecutor) runLocal(inv *saltInvocation, stdout io.Writer) error {
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	chunk := map[string]interface{}{
+		"client":   "local_async",
+		"tgt":      inv.tgt,
+		"tgt_type": inv.tgtType,
+		"fun":      inv.fun,
+	}
+	if len(inv.args) > 0 {
+		chunk["arg"] = inv.args
+	}
+	if len(inv.kwargs) > 0 {
+		chunk["kwarg"] = inv.kwargs
+	}
+	var job struct {
+		JID     string   `json:"jid"`
+		Minions []string `json:"minions"`
+	}
+	if err := e.lowstate(chunk, &job); err != nil {
+		return err
+	}
+	if job.JID == "" {
+		return errors.New("No minions matched the target")
+	}
+	if inv.async {
+		fmt.Fprintf(stdout, "Executed command with job ID: %v\n", job.JID)
+		return nil
+	}
+	if inv.showJID {
+		fmt.Fprintf(stdout, "jid: %v\n", job.JID)
+	}
+
+	printed := make(map[string]bool)
+	all := make(map[string]json.RawMessage)
+	deadline := time.Now().Add(inv.timeout)
+	for {
+		_, returns, err := e.jobReturns(job.JID)
+		if err != nil {
+			return err
+		}
+		for _, minion := range sortedKeys(returns) {
+			if printed[minion] {
+				continue
+			}
+			printed[minion] = true
+			all[minion] = returns[minion]
+			if !inv.static {
+				writeMinionReturn(stdout, inv.out, minion, returns[minion])
+			}
+		}
+		if len(printed) >= len(job.Minions) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(saltAPIPollInterval)
+	}
+
+	for _, minion := range job.Minions {
+		if !printed[minion] {
+			all[minion], _ = json.Marshal(noResponseReturn)
+			if !inv.static {
+				writeMinionReturn(stdout, inv.out, minion, all[minion])
+			}
+		}
+	}
+	if inv.static {
+		writeReturns(stdout, inv.out, all)
+	}
+	return nil
+}
+
+// runRunner runs a salt runner function on the master
+func (e *saltAPIExecutor) runRunner(inv *saltInvocation, stdout io.Writer) error {
+	chunk := map[string]interface{}{
+		"client": "runner",
+		"fun":    inv.fun,
+	}
+	if len(inv.args) > 0 {
+		chunk["arg"] = inv.args
+	}
+	for key, value := range inv.kwargs {
+		chunk[key] = value
+	}
+	var result json.RawMessage
+	if err := e.lowstate(chunk, &result); err != nil {
+		return err
+	}
+	if stdout == nil {
+		return nil
+	}
+	if inv.out == "json" {
+		_, err := fmt.Fprintf(stdout, "%s\n", result)
+		return err
+	}
+	return writeYAML(stdout, result, "")
+}
+
+// noResponseReturn is the return salt reports for minions that did not return
+const noResponseReturn = "Minion did not return. [No response]"
+
+// writeMinionReturn writes one minion's return as the salt cli does for the out format
+func writeMinionReturn(w io.Writer, out, minion string, ret json.RawMessage) {
+	if out == "json" {
+		buf, _ := json.Marshal(map[string]json.RawMessage{minion: ret})
+		fmt.Fprintf(w, "%s\n", buf)
+		return
+	}
+	fmt.Fprintf(w, "%v:\n", minion)
+	writeYAML(w, ret, "    ")
+}
+
+// writeReturns writes every minion's return as a single document for --static
+func writeReturns(w io.Writer, out string, returns map[string]json.RawMessage) {
+	if out == "json" {
+		buf, _ := json.Marshal(returns)
+		fmt.Fprintf(w, "%s\n", buf)
+		return
+	}
+	for _, minion := range sortedKeys(returns) {
+		writeMinionReturn(w, out, minion, returns[minion])
+	}
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// joinPath joins an api path to baseURL
+func joinPath(baseURL, path string) string {
+	return strings.TrimRight(baseURL, "/") + path
+}
@@ -0,0 +1,285 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// useTempState points the csalt state directory at a temporary home, the returned func removes it
+func useTempState(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "csalt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := homeDir
+	homeDir = func() (string, error) { return dir, nil }
+	return func() {
+		homeDir = previous
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeSaltAPI is a salt-api serving a single job whose returns are revealed one poll at a time
+type fakeSaltAPI struct {
+	t       *testing.T
+	mu      sync.Mutex
+	logins  int
+	chunks  []map[string]interface{}
+	minions []string
+	// polls are the returns of each /jobs poll, the last is repeated
+	polls []map[string]interface{}
+	poll  int
+}
+
+func (f *fakeSaltAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/login" {
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["username"] != "admin" || login["password"] != "secret" || login["eauth"] != "pam" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.logins++
+		expire := float64(time.Now().Add(time.Hour).Unix())
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"return": []interface{}{map[string]interface{}{"token": "tok", "expire": expire}},
+		})
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != "tok" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/":
+		var chunks []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&chunks)
+		f.chunks = append(f.chunks, chunks...)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"return": []interface{}{map[string]interface{}{"jid": "20261018000001", "minions": f.minions}},
+		})
+	case r.Method == "GET" && r.URL.Path == "/jobs/20261018000001":
+		returns := f.polls[f.poll]
+		if f.poll < len(f.polls)-1 {
+			f.poll++
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"info":   []interface{}{map[string]interface{}{"Minions": f.minions}},
+			"return": []interface{}{returns},
+		})
+	default:
+		f.t.Errorf("unexpected request %v %v", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestSaltAPI(t *testing.T, api *fakeSaltAPI) (*saltAPIExecutor, func()) {
+	api.t = t
+	server := httptest.NewServer(api)
+	e, err := newSaltAPIExecutor(&userapi.SaltAPI{Url: server.URL, UserName: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.password = func() ([]byte, error) { return []byte("secret"), nil }
+	restoreState := useTempState(t)
+	return e, func() {
+		server.Close()
+		restoreState()
+	}
+}
+
+// jsonLines decodes each line of output as a json object of minion returns
+func jsonLines(t *testing.T, output string) map[string]interface{} {
+	returns := make(map[string]interface{})
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if strings.HasPrefix(line, "jid: ") {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line), &returns); err != nil {
+			t.Fatalf("invalid json line %q: %v", line, err)
+		}
+	}
+	return returns
+}
+
+func TestSaltAPIRunLocal(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"pi-1", "pi-2"},
+		polls: []map[string]interface{}{
+			{"pi-1": true},
+			{"pi-1": true, "pi-2": true},
+		},
+	}
+	e, cleanup := newTestSaltAPI(t, api)
+	defer cleanup()
+
+	var stdout strings.Builder
+	cmd := &saltCmd{binary: "salt", args: []string{"--out=json", "--show-jid", "-L", "pi-1 pi-2", "test.ping"}, stdout: &stdout}
+	if err := e.Run(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout.String(), "jid: 20261018000001\n") {
+		t.Errorf("missing jid line in %q", stdout.String())
+	}
+	want := map[string]interface{}{"pi-1": true, "pi-2": true}
+	if got := jsonLines(t, stdout.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("returns = %v, want %v", got, want)
+	}
+	if api.logins != 1 {
+		t.Errorf("logged in %v times, want once", api.logins)
+	}
+	wantChunk := map[string]interface{}{
+		"client":   "local_async",
+		"tgt":      []interface{}{"pi-1", "pi-2"},
+		"tgt_type": "list",
+		"fun":      "test.ping",
+	}
+	if len(api.chunks) != 1 || !reflect.DeepEqual(api.chunks[0], wantChunk) {
+		t.Errorf("lowstate = %v, want %v", api.chunks, wantChunk)
+	}
+
+	// the saved token is reused by a new executor
+	e2, err := newSaltAPIExecutor(&e.conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2.password = func() ([]byte, error) {
+		t.Error("asked for a password with a saved token")
+		return nil, nil
+	}
+	if token, err := e2.login(); err != nil || token != "tok" {
+		t.Errorf("login() = %v, %v, want the saved token", token, err)
+	}
+}
+
+func TestSaltAPIRunLocalTimeout(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"pi-1", "pi-2"},
+		polls:   []map[string]interface{}{{"pi-1": true}},
+	}
+	e, cleanup := newTestSaltAPI(t, api)
+	defer cleanup()
+
+	var stdout strings.Builder
+	cmd := &saltCmd{binary: "salt", args: []string{"--out=json", "-t", "0", "-L", "pi-1 pi-2", "test.ping"}, stdout: &stdout}
+	if err := e.Run(cmd); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"pi-1": true, "pi-2": noResponseReturn}
+	if got := jsonLines(t, stdout.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("returns = %v, want %v", got, want)
+	}
+}
+
+func TestSaltAPIRevokedToken(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"pi-1"},
+		polls:   []map[string]interface{}{{"pi-1": true}},
+	}
+	e, cleanup := newTestSaltAPI(t, api)
+	defer cleanup()
+	revoked := saltAPIToken{URL: e.conf.Url, UserName: "admin", Token: "revoked", Expire: float64(time.Now().Add(time.Hour).Unix())}
+	if err := writeStateFile(saltAPITokenFile, &revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout strings.Builder
+	cmd := &saltCmd{binary: "salt", args: []string{"--out=json", "-L", "pi-1", "test.ping"}, stdout: &stdout}
+	if err := e.Run(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if api.logins != 1 {
+		t.Errorf("logged in %v times, want once after the saved token was rejected", api.logins)
+	}
+	var saved saltAPIToken
+	if err := readStateFile(saltAPITokenFile, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Token != "tok" {
+		t.Errorf("saved token = %q, want the new token", saved.Token)
+	}
+}
+
+func TestSaltAPILoginFailed(t *testing.T) {
+	e, cleanup := newTestSaltAPI(t, &fakeSaltAPI{})
+	defer cleanup()
+	e.password = func() ([]byte, error) { return []byte("wrong"), nil }
+	if err := e.Run(&saltCmd{binary: "salt", args: []string{"pi-1", "test.ping"}}); err == nil {
+		t.Error("expected an error for a rejected login")
+	}
+}
+
+func TestParseSaltArgs(t *testing.T) {
+	inv, err := parseSaltArgs("salt", []string{"--out=json", "--static", "-t", "30", "-L", "pi-1 pi-2",
+		"cmd.run", "uptime", "runas=pi", "timeout=5", "test=True"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.tgtType != "list" || !reflect.DeepEqual(inv.tgt, []string{"pi-1", "pi-2"}) {
+		t.Errorf("target = %v %v", inv.tgtType, inv.tgt)
+	}
+	if inv.fun != "cmd.run" || !reflect.DeepEqual(inv.args, []interface{}{"uptime"}) {
+		t.Errorf("fun = %v args = %v", inv.fun, inv.args)
+	}
+	wantKwargs := map[string]interface{}{"runas": "pi", "timeout": 5, "test": true}
+	if !reflect.DeepEqual(inv.kwargs, wantKwargs) {
+		t.Errorf("kwargs = %#v, want %#v", inv.kwargs, wantKwargs)
+	}
+	if inv.out != "json" || !inv.static || inv.timeout != 30*time.Second {
+		t.Errorf("out = %v static = %v timeout = %v", inv.out, inv.static, inv.timeout)
+	}
+
+	inv, err = parseSaltArgs("salt", []string{"-N", "group1", "state.apply", "--", "-weird"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.tgtType != "nodegroup" || inv.tgt != "group1" || !reflect.DeepEqual(inv.args, []interface{}{"-weird"}) {
+		t.Errorf("unexpected invocation %+v", inv)
+	}
+
+	// salt jids have 20 digits, too many for an int64
+	inv, err = parseSaltArgs("salt-run", []string{"--out=json", "jobs.lookup_jid", "20261018132328123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.fun != "jobs.lookup_jid" || !reflect.DeepEqual(inv.args, []interface{}{"20261018132328123456"}) {
+		t.Errorf("fun = %v args = %#v", inv.fun, inv.args)
+	}
+
+	for _, args := range [][]string{
+		{"pi-1"},
+		{"--batch", "10", "pi-1", "test.ping"},
+		{"-t"},
+	} {
+		if _, err := parseSaltArgs("salt", args); err == nil {
+			t.Errorf("parseSaltArgs(%q) should fail", args)
+		}
+	}
+}
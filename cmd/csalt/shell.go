@@ -0,0 +1,394 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+const (
+	shellPrompt      = "csalt> "
+	shellHistoryFile = "shell-history.yaml"
+	// shellHistoryLen is how many commands :history lists
+	shellHistoryLen = 20
+	// shellHistoryMax is how many commands are kept in the history file
+	shellHistoryMax = 500
+)
+
+const shellHelp = `Enter salt arguments to run them on the targets e.g. test.ping or cmd.run "uptime"
+  :targets            list the targets
+  :add DEVICEINFO     resolve DEVICEINFO and add the devices to the targets
+  :remove DEVICEINFO  remove the devices matching DEVICEINFO from the targets
+  :history            list the previous commands, !N runs command N again
+  :help               show this help
+  :quit               exit, as does Ctrl-D`
+
+type ShellArgs struct {
+	DeviceInfo DeviceQuery `arg:"positional,required"`
+	ChunkSize  int         `arg:"--chunk-size" help:"Run salt on at most this many devices at a time"`
+	Parallel   int         `help:"Number of salt commands to run at once when commands use {group}, {device} or {saltid}"`
+	ServerArgs
+}
+
+func (ShellArgs) Description() string {
+	return `Resolve devices once and open a prompt that runs salt commands on them, printing each device's
+return under its friendly name. Targets can be changed with :add and :remove, see :help.
+
+Example:
+csalt shell "group1:,group2:"
+csalt> test.ping
+csalt> :remove gp
+csalt> cmd.run "df -h /"`
+}
+
+// shell is an interactive session running salt commands on a fixed set of targets
+type shell struct {
+	api     *userapi.CacophonyUserAPI
+	server  *userapi.Server
+	args    ShellArgs
+	targets []target
+	// deviceInfo describes the targets in the audit log, the devices once they have been changed
+	deviceInfo string
+	history    []string
+}
+
+func runShell(argv []string) error {
+	args := ShellArgs{ChunkSize: defaultChunkSize, Parallel: defaultParallel}
+	parseSubcommand("shell", argv, &args)
+	api, server, err := connect(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	sh := &shell{api: api, server: server, args: args, deviceInfo: args.DeviceInfo.rawArg}
+	if err := sh.add(&args.DeviceInfo); err != nil {
+		return err
+	}
+	if len(sh.targets) == 0 {
+		return errors.New("No valid devices found")
+	}
+	if err := readStateFile(shellHistoryFile, &sh.history); err != nil {
+		fmt.Printf("Error reading shell history %v\n", err)
+	}
+	sh.history = lastCommands(sh.history, shellHistoryMax)
+	fmt.Printf("%v targets, :help lists the shell commands\n", len(sh.targets))
+
+	reader := newLineReader()
+	for {
+		line, err := reader.ReadLine()
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "!") {
+			if line, err = sh.previous(line[1:]); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println(line)
+		}
+		if line == "" {
+			continue
+		}
+		if line == ":quit" || line == ":exit" {
+			return nil
+		}
+		sh.remember(line)
+		if err := sh.execute(line); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+}
+
+// execute runs a shell command or salt arguments
+func (sh *shell) execute(line string) error {
+	if !strings.HasPrefix(line, ":") {
+		argCommands, err := splitShellArgs(line)
+		if err != nil {
+			return err
+		}
+		return sh.run(argCommands)
+	}
+	command, rest := line, ""
+	if pos := strings.IndexAny(line, " \t"); pos >= 0 {
+		command, rest = line[:pos], strings.TrimSpace(line[pos+1:])
+	}
+	switch command {
+	case ":help":
+		fmt.Println(shellHelp)
+	case ":targets":
+		printTargets(fmt.Sprintf("%v targets:", len(sh.targets)), sh.targets)
+	case ":history":
+		start := len(sh.history) - shellHistoryLen
+		if start < 0 {
+			start = 0
+		}
+		for i := start; i < len(sh.history); i++ {
+			fmt.Printf("%5v  %v\n", i+1, sh.history[i])
+		}
+	case ":add", ":remove":
+		if rest == "" {
+			return fmt.Errorf("%v needs DEVICEINFO", command)
+		}
+		var query DeviceQuery
+		query.UnmarshalText([]byte(rest))
+		before := len(sh.targets)
+		if command == ":add" {
+			if err := sh.add(&query); err != nil {
+				return err
+			}
+			fmt.Printf("Added %v devices, %v targets\n", len(sh.targets)-before, len(sh.targets))
+		} else {
+			if err := sh.remove(&query); err != nil {
+				return err
+			}
+			fmt.Printf("Removed %v devices, %v targets\n", before-len(sh.targets), len(sh.targets))
+		}
+		labels := make([]string, len(sh.targets))
+		for i, t := range sh.targets {
+			labels[i] = t.Label()
+		}
+		sh.deviceInfo = strings.Join(labels, ",")
+	default:
+		return fmt.Errorf("unknown command %v, see :help", command)
+	}
+	return nil
+}
+
+// run runs argCommands on the targets, recording the run like a csalt command line run
+func (sh *shell) run(argCommands []string) error {
+	if len(sh.targets) == 0 {
+		return errors.New("no targets, use :add")
+	}
+	p := perDevice{parallel: sh.args.Parallel}
+	if err := p.check(argCommands); err != nil {
+		return err
+	}
+	size := sh.args.ChunkSize
+	if size <= 0 {
+		size = len(sh.targets)
+	}
+	entry := newRunLogEntry(sh.server, "salt", argCommands)
+	entry.SetTargets(sh.deviceInfo, sh.targets)
+	result, err := runBatches(sh.targets, argCommands, batchOptions{size: size, name: "chunk", maxFailures: -1, perDevice: p, progress: true})
+	if err != nil {
+		entry.Finish(result.JIDs, err)
+		return err
+	}
+	// failed devices are listed in the run summary so only the audit log records them as an error
+	entry.Finish(result.JIDs, runError(result))
+	if err := recordLastRun(sh.server.Url, argCommands, result); err != nil {
+		fmt.Printf("Error saving last run %v\n", err)
+	}
+	if stateFunctions[saltFunction(argCommands)] {
+		printStateSummary(result)
+	}
+	return nil
+}
+
+// add resolves query and adds the devices that aren't already targets
+func (sh *shell) add(query *DeviceQuery) error {
+	devResp, err := translateDevices(sh.api, query)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(sh.targets))
+	for _, t := range sh.targets {
+		existing[t.MinionID] = true
+	}
+	for _, t := range newTargets(sh.server, append(devResp.Devices, devResp.NameMatches...)) {
+		if !existing[t.MinionID] {
+			existing[t.MinionID] = true
+			sh.targets = append(sh.targets, t)
+		}
+	}
+	return nil
+}
+
+// remove removes the targets matching query without asking the API
+func (sh *shell) remove(query *DeviceQuery) error {
+	lastRun := make(map[string]bool)
+	if len(query.lastRun) > 0 {
+		devices, err := lastRunDevices(sh.server.Url, query.lastRun)
+		if err != nil {
+			return err
+		}
+		for _, t := range newTargets(sh.server, devices) {
+			lastRun[t.MinionID] = true
+		}
+	}
+	var kept []target
+	for _, t := range sh.targets {
+		if !lastRun[t.MinionID] && !query.matches(t.Device) {
+			kept = append(kept, t)
+		}
+	}
+	sh.targets = kept
+	return nil
+}
+
+// matches returns true if device is in one of the groups or has one of the device names of devQ
+func (devQ *DeviceQuery) matches(device userapi.Device) bool {
+	for _, group := range devQ.groups {
+		if device.GroupName == group {
+			return true
+		}
+	}
+	for _, d := range devQ.devices {
+		if d.DeviceName == device.DeviceName && (d.GroupName == "" || d.GroupName == device.GroupName) {
+			return true
+		}
+	}
+	return false
+}
+
+// previous returns the history entry numbered n, or the last entry for !
+func (sh *shell) previous(n string) (string, error) {
+	if len(sh.history) == 0 {
+		return "", errors.New("no history")
+	}
+	if n == "!" {
+		return sh.history[len(sh.history)-1], nil
+	}
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(sh.history) {
+		return "", fmt.Errorf("no history entry %v", n)
+	}
+	return sh.history[i-1], nil
+}
+
+// remember adds line to the history, saving the most recent commands for :history and !N in
+// later sessions
+func (sh *shell) remember(line string) {
+	sh.history = append(sh.history, line)
+	if err := writeStateFile(shellHistoryFile, lastCommands(sh.history, shellHistoryMax)); err != nil {
+		fmt.Printf("Error saving shell history %v\n", err)
+	}
+}
+
+// lastCommands returns at most the last n commands of history
+func lastCommands(history []string, n int) []string {
+	if len(history) > n {
+		return history[len(history)-n:]
+	}
+	return history
+}
+
+// splitShellArgs splits line into arguments on spaces like a shell, keeping quoted text together
+func splitShellArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// lineReader reads the shell's input a line at a time
+type lineReader interface {
+	ReadLine() (string, error)
+}
+
+// newLineReader returns a reader with line editing and arrow key history when stdin is a
+// terminal, otherwise one that reads plain lines. The terminal can't be given the saved history
+// so the arrow keys only reach this session's commands
+func newLineReader() lineReader {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return &scanLineReader{bufio.NewScanner(os.Stdin)}
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+	return &terminalLineReader{fd: fd, term: terminal.NewTerminal(rw, shellPrompt)}
+}
+
+type terminalLineReader struct {
+	fd   int
+	term *terminal.Terminal
+}
+
+// ReadLine puts the terminal in raw mode only while reading so salt's output prints normally
+func (r *terminalLineReader) ReadLine() (string, error) {
+	state, err := terminal.MakeRaw(r.fd)
+	if err != nil {
+		return "", err
+	}
+	defer terminal.Restore(r.fd, state)
+	return r.term.ReadLine()
+}
+
+type scanLineReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *scanLineReader) ReadLine() (string, error) {
+	fmt.Print(shellPrompt)
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return r.scanner.Text(), nil
+}
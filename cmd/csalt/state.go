@@ -0,0 +1,113 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"os/user"
+	"path"
+
+	"gopkg.in/yaml.v1"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+// stateDir is the directory in the users home that csalt keeps caches and history in
+const stateDir = ".csalt"
+
+// homeDir returns the directory holding stateDir, tests replace it to keep their state apart
+var homeDir = func() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return usr.HomeDir, nil
+}
+
+// statePath returns the path of name inside the csalt state directory, creating the
+// directory if needed
+func statePath(name string) (string, error) {
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(home, stateDir)
+	if err := userapi.Fs.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return path.Join(dir, name), nil
+}
+
+// readStateFile acquires a read lock and unmarshals the yaml state file into v.
+// A missing file leaves v untouched
+func readStateFile(name string, v interface{}) error {
+	filePath, err := statePath(name)
+	if err != nil {
+		return err
+	}
+	buf, err := userapi.NewLockSafeConfig(filePath).Read()
+	if err != nil || buf == nil {
+		return err
+	}
+	return yaml.Unmarshal(buf, v)
+}
+
+// writeStateFile acquires an exclusive lock and saves v as yaml to the state file
+func writeStateFile(name string, v interface{}) error {
+	filePath, err := statePath(name)
+	if err != nil {
+		return err
+	}
+	buf, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	lockSafeConfig := userapi.NewLockSafeConfig(filePath)
+	if _, err := lockSafeConfig.ExLock(); err != nil {
+		return err
+	}
+	defer lockSafeConfig.Unlock()
+	return lockSafeConfig.Write(buf)
+}
+
+// updateStateFile holds an exclusive lock while the yaml state file is read into v, changed by
+// update and saved, so concurrent updates don't overwrite each other
+func updateStateFile(name string, v interface{}, update func() error) error {
+	filePath, err := statePath(name)
+	if err != nil {
+		return err
+	}
+	lockSafeConfig := userapi.NewLockSafeConfig(filePath)
+	if _, err := lockSafeConfig.ExLock(); err != nil {
+		return err
+	}
+	defer lockSafeConfig.Unlock()
+	buf, err := lockSafeConfig.Read()
+	if err != nil {
+		return err
+	}
+	if buf != nil {
+		if err := yaml.Unmarshal(buf, v); err != nil {
+			return err
+		}
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	if buf, err = yaml.Marshal(v); err != nil {
+		return err
+	}
+	return lockSafeConfig.Write(buf)
+}
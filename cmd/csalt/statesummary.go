@@ -0,0 +1,202 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// stateFunctions are the salt functions whose returns are state results
+var stateFunctions = map[string]bool{
+	"state.apply":     true,
+	"state.highstate": true,
+	"state.sls":       true,
+}
+
+// stateReturn is the return of a single state, result is nil when test=True would make changes
+type stateReturn struct {
+	Result  *bool                  `json:"result"`
+	Changes map[string]interface{} `json:"changes"`
+	Comment interface{}            `json:"comment"`
+	RunNum  int                    `json:"__run_num__"`
+}
+
+// failedState is a state that failed on a device
+type failedState struct {
+	Name    string
+	Comment string
+}
+
+// stateSummary counts the state results of one device
+type stateSummary struct {
+	Succeeded int
+	Changed   int
+	Pending   int
+	Failed    []failedState
+	// Error is set when the device returned something other than state results
+	Error string
+}
+
+// stateName returns a readable name for a state key such as pkg_|-api_|-cacophony-api_|-installed,
+// e.g. pkg.installed api
+func stateName(key string) string {
+	parts := strings.Split(key, "_|-")
+	if len(parts) != 4 {
+		return key
+	}
+	return fmt.Sprintf("%v.%v %v", parts[0], parts[3], parts[1])
+}
+
+// stateComment flattens a state comment, which salt returns as a string or a list of strings
+func stateComment(comment interface{}) string {
+	switch value := comment.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		lines := make([]string, len(value))
+		for i, line := range value {
+			lines[i] = fmt.Sprint(line)
+		}
+		return strings.Join(lines, "; ")
+	}
+	return strings.TrimSpace(fmt.Sprint(comment))
+}
+
+// parseStateReturns decodes the state results of a device's return, ordered as salt ran them
+func parseStateReturns(ret json.RawMessage) (map[string]stateReturn, []string, error) {
+	var states map[string]stateReturn
+	if err := json.Unmarshal(ret, &states); err != nil {
+		var value interface{}
+		json.Unmarshal(ret, &value)
+		return nil, nil, fmt.Errorf("%v", stateComment(value))
+	}
+	keys := make([]string, 0, len(states))
+	for key := range states {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return states[keys[i]].RunNum < states[keys[j]].RunNum
+	})
+	return states, keys, nil
+}
+
+// summarizeStates counts the succeeded, changed and failed states in a device's return
+func summarizeStates(ret json.RawMessage) stateSummary {
+	var summary stateSummary
+	states, keys, err := parseStateReturns(ret)
+	if err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+	for _, key := range keys {
+		state := states[key]
+		switch {
+		case state.Result == nil:
+			summary.Pending++
+		case *state.Result:
+			summary.Succeeded++
+		default:
+			summary.Failed = append(summary.Failed, failedState{Name: stateName(key), Comment: stateComment(state.Comment)})
+		}
+		if len(state.Changes) > 0 {
+			summary.Changed++
+		}
+	}
+	return summary
+}
+
+// groupStateTotals is the state results of every device in a group
+type groupStateTotals struct {
+	Devices       int
+	FailedDevices int
+	Succeeded     int
+	Changed       int
+	Pending       int
+	Failed        int
+}
+
+// printStateSummary prints the succeeded, changed and failed states of every device in result,
+// the failed states with their comments and totals for each group
+func printStateSummary(result *runResult) {
+	if len(result.Results) == 0 {
+		return
+	}
+	results := append([]minionResult(nil), result.Results...)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Label() < results[j].Label()
+	})
+
+	fmt.Println("\nState summary:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tSUCCEEDED\tCHANGED\tPENDING\tFAILED")
+	groups := make(map[string]*groupStateTotals)
+	var failures []string
+	for _, res := range results {
+		summary := summarizeStates(res.Return)
+		totals, ok := groups[res.Device.GroupName]
+		if !ok {
+			totals = &groupStateTotals{}
+			groups[res.Device.GroupName] = totals
+		}
+		totals.Devices++
+		if summary.Error != "" || len(summary.Failed) > 0 {
+			totals.FailedDevices++
+		}
+		totals.Succeeded += summary.Succeeded
+		totals.Changed += summary.Changed
+		totals.Pending += summary.Pending
+		totals.Failed += len(summary.Failed)
+
+		if summary.Error != "" {
+			fmt.Fprintf(tw, "%v\t-\t-\t-\t-\n", res.Label())
+			failures = append(failures, fmt.Sprintf("%v: %v", res.Label(), summary.Error))
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", res.Label(), summary.Succeeded, summary.Changed,
+			summary.Pending, len(summary.Failed))
+		for _, state := range summary.Failed {
+			failures = append(failures, fmt.Sprintf("%v: %v: %v", res.Label(), state.Name, state.Comment))
+		}
+	}
+	tw.Flush()
+
+	if len(failures) > 0 {
+		fmt.Println("\nFailed states:")
+		for _, failure := range failures {
+			fmt.Printf("  %v\n", failure)
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("\nTotals by group:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tDEVICES\tFAILED DEVICES\tSUCCEEDED\tCHANGED\tPENDING\tFAILED")
+	for _, name := range names {
+		totals := groups[name]
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", name, totals.Devices, totals.FailedDevices,
+			totals.Succeeded, totals.Changed, totals.Pending, totals.Failed)
+	}
+	tw.Flush()
+}
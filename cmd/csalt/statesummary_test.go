@@ -0,0 +1,75 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStateName(t *testing.T) {
+	tests := []struct {
+		key  string
+		name string
+	}{
+		{"pkg_|-api_|-cacophony-api_|-installed", "pkg.installed api"},
+		{"file_|-thermal-config_|-/etc/cacophony/config.toml_|-managed", "file.managed thermal-config"},
+		{"no separators", "no separators"},
+		{"a_|-b_|-c", "a_|-b_|-c"},
+	}
+	for _, test := range tests {
+		if name := stateName(test.key); name != test.name {
+			t.Errorf("stateName(%q) = %q, want %q", test.key, name, test.name)
+		}
+	}
+}
+
+func TestSummarizeStates(t *testing.T) {
+	tests := []struct {
+		ret     string
+		summary stateSummary
+	}{
+		{
+			`{"pkg_|-a_|-a_|-installed": {"result": true, "changes": {}, "__run_num__": 0},
+			  "file_|-b_|-/b_|-managed": {"result": true, "changes": {"diff": "new"}, "__run_num__": 1},
+			  "service_|-c_|-c_|-running": {"result": null, "changes": {}, "__run_num__": 2}}`,
+			stateSummary{Succeeded: 2, Changed: 1, Pending: 1},
+		},
+		{
+			`{"file_|-b_|-/b_|-managed": {"result": false, "comment": ["Source file", "not found"], "__run_num__": 1},
+			  "cmd_|-c_|-c_|-run": {"result": false, "comment": " exit 1 ", "__run_num__": 0}}`,
+			stateSummary{Failed: []failedState{
+				{Name: "cmd.run c", Comment: "exit 1"},
+				{Name: "file.managed b", Comment: "Source file; not found"},
+			}},
+		},
+		{
+			`["Rendering SLS 'base:foo' failed", "mapping values are not allowed"]`,
+			stateSummary{Error: "Rendering SLS 'base:foo' failed; mapping values are not allowed"},
+		},
+		{
+			`"Minion did not return. [No response]"`,
+			stateSummary{Error: "Minion did not return. [No response]"},
+		},
+	}
+	for _, test := range tests {
+		summary := summarizeStates(json.RawMessage(test.ret))
+		if !reflect.DeepEqual(summary, test.summary) {
+			t.Errorf("summarizeStates(%v) = %+v, want %+v", test.ret, summary, test.summary)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultParallel = 10
+
+// templatePlaceholders are replaced in salt arguments with the values of each device
+var templatePlaceholders = []string{"{group}", "{device}", "{saltid}"}
+
+// isTemplated returns true if any of argCommands contain a device placeholder
+func isTemplated(argCommands []string) bool {
+	for _, arg := range argCommands {
+		for _, placeholder := range templatePlaceholders {
+			if strings.Contains(arg, placeholder) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandTemplate returns argCommands with the placeholders replaced by the values of t
+func expandTemplate(argCommands []string, t target) []string {
+	replacer := strings.NewReplacer(
+		"{group}", t.Device.GroupName,
+		"{device}", t.Device.DeviceName,
+		"{saltid}", strconv.Itoa(t.Device.SaltId),
+	)
+	expanded := make([]string, len(argCommands))
+	for i, arg := range argCommands {
+		expanded[i] = replacer.Replace(arg)
+	}
+	return expanded
+}
+
+// pillarKey is the top level pillar key of the device metadata passed with --pillar
+const pillarKey = "cacophony"
+
+// perDevice describes when and how a separate salt command is run for each device
+type perDevice struct {
+	// parallel is how many per device salt commands run at once
+	parallel int
+	// pillar passes each device's API metadata as inline pillar
+	pillar bool
+}
+
+// enabled returns true if argCommands must be run separately for each device
+func (p perDevice) enabled(argCommands []string) bool {
+	return p.pillar || isTemplated(argCommands)
+}
+
+// commands returns the salt arguments to run on t
+func (p perDevice) commands(argCommands []string, t target) []string {
+	commands := expandTemplate(argCommands, t)
+	if p.pillar {
+		buf, _ := json.Marshal(map[string]interface{}{pillarKey: devicePillar(t)})
+		commands = append(commands, "pillar="+string(buf))
+	}
+	return commands
+}
+
+// devicePillar returns every field the API returned for the device of t along with its
+// group, device, saltId and minionId
+func devicePillar(t target) map[string]interface{} {
+	pillar := make(map[string]interface{}, len(t.Device.Fields)+4)
+	for key, value := range t.Device.Fields {
+		pillar[key] = value
+	}
+	pillar["group"] = t.Device.GroupName
+	pillar["device"] = t.Device.DeviceName
+	pillar["saltId"] = t.Device.SaltId
+	pillar["minionId"] = t.MinionID
+	return pillar
+}
+
+// check returns an error if argCommands can't be run per device as p requires
+func (p perDevice) check(argCommands []string) error {
+	if !p.pillar {
+		return nil
+	}
+	if !stateFunctions[saltFunction(argCommands)] {
+		return errors.New("--pillar can only be used with state.apply, state.highstate or state.sls")
+	}
+	for _, arg := range argCommands {
+		if strings.HasPrefix(arg, "pillar=") {
+			return errors.New("--pillar can't be combined with a pillar= argument")
+		}
+	}
+	return nil
+}
+
+// collectTargets runs argCommands on targets like collectSalt. When p is enabled a separate salt
+// command is run for each device, p.parallel at a time, and a device whose command fails is
+// reported as failed
+func collectTargets(targets []target, argCommands []string, onResult func(minionResult), p perDevice) (*runResult, error) {
+	if !p.enabled(argCommands) {
+		return collectSalt(targets, argCommands, onResult)
+	}
+	parallel := p.parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	if len(targets) < parallel {
+		parallel = len(targets)
+	}
+	jobs := make(chan target)
+	total := &runResult{}
+	var mu sync.Mutex
+	var workers sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for t := range jobs {
+				result, err := collectSalt([]target{t}, p.commands(argCommands, t), onResult)
+				if err != nil {
+					// a device whose salt command fails is reported like any other failure
+					ret, _ := json.Marshal(fmt.Sprintf("ERROR: %v", err))
+					res := minionResult{target: t, Status: statusFailed, Return: ret}
+					result = &runResult{Results: []minionResult{res}}
+					if onResult != nil {
+						onResult(res)
+					}
+				}
+				mu.Lock()
+				total.add(result)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, t := range targets {
+		jobs <- t
+	}
+	close(jobs)
+	workers.Wait()
+	return total, nil
+}
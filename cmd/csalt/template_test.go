@@ -0,0 +1,95 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/TheCacophonyProject/csalt/userapi"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	device := target{Device: userapi.Device{GroupName: "g1", DeviceName: "cam 1", SaltId: 12}, MinionID: "pi-12"}
+	argCommands := []string{"grains.setval", "device_name", "{group}/{device}", "id={saltid}"}
+	want := []string{"grains.setval", "device_name", "g1/cam 1", "id=12"}
+	if expanded := expandTemplate(argCommands, device); !reflect.DeepEqual(expanded, want) {
+		t.Errorf("expandTemplate = %q, want %q", expanded, want)
+	}
+	if isTemplated([]string{"test.ping"}) || !isTemplated(argCommands) {
+		t.Error("isTemplated should only be true with placeholders")
+	}
+}
+
+func TestDevicePillar(t *testing.T) {
+	device := userapi.Device{
+		GroupName:  "g1",
+		DeviceName: "cam1",
+		SaltId:     12,
+		Fields:     map[string]interface{}{"id": 7.0, "active": true, "device": "api value"},
+	}
+	want := map[string]interface{}{
+		"id":       7.0,
+		"active":   true,
+		"group":    "g1",
+		"device":   "cam1",
+		"saltId":   12,
+		"minionId": "pi-12",
+	}
+	if pillar := devicePillar(target{Device: device, MinionID: "pi-12"}); !reflect.DeepEqual(pillar, want) {
+		t.Errorf("devicePillar = %v, want %v", pillar, want)
+	}
+}
+
+func TestPerDeviceCommands(t *testing.T) {
+	device := target{Device: userapi.Device{GroupName: "g1", DeviceName: "cam1", SaltId: 12}, MinionID: "pi-12"}
+	commands := perDevice{pillar: true}.commands([]string{"state.apply", "{device}"}, device)
+	if len(commands) != 3 || commands[1] != "cam1" || !strings.HasPrefix(commands[2], "pillar=") {
+		t.Fatalf("commands = %q", commands)
+	}
+
+	// the pillar reaches the salt-api as data, salt won't parse it again on the minion
+	inv, err := parseSaltArgs("salt", append([]string{"pi-12"}, commands...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		pillarKey: map[string]interface{}{"group": "g1", "device": "cam1", "saltId": 12, "minionId": "pi-12"},
+	}
+	if !reflect.DeepEqual(inv.kwargs["pillar"], want) {
+		t.Errorf("pillar = %#v, want %#v", inv.kwargs["pillar"], want)
+	}
+}
+
+func TestPerDeviceCheck(t *testing.T) {
+	tests := []struct {
+		p           perDevice
+		argCommands []string
+		ok          bool
+	}{
+		{perDevice{}, []string{"cmd.run", "uptime"}, true},
+		{perDevice{pillar: true}, []string{"state.apply", "thermal-recorder"}, true},
+		{perDevice{pillar: true}, []string{"state.highstate"}, true},
+		{perDevice{pillar: true}, []string{"cmd.run", "uptime"}, false},
+		{perDevice{pillar: true}, []string{"state.apply", `pillar={"a": 1}`}, false},
+	}
+	for _, test := range tests {
+		if err := test.p.check(test.argCommands); (err == nil) != test.ok {
+			t.Errorf("check(%q) with pillar %v = %v", test.argCommands, test.p.pillar, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultWatchInterval = 30 * time.Second
+	// maxWatchValueLen is the most characters of a return shown so each device fits on one line
+	maxWatchValueLen = 80
+
+	clearScreen    = "\033[H\033[2J"
+	highlightStart = "\033[1;33m"
+	highlightEnd   = "\033[0m"
+)
+
+type WatchArgs struct {
+	DeviceInfo DeviceQuery   `arg:"positional,required"`
+	Commands   []string      `arg:"positional"`
+	Interval   time.Duration `help:"Time between runs e.g. 30s or 5m"`
+	Count      int           `arg:"-n" help:"Stop after this many runs, 0 runs until interrupted"`
+	ChunkSize  int           `arg:"--chunk-size" help:"Run salt on at most this many devices at a time"`
+	ServerArgs
+}
+
+func (WatchArgs) Description() string {
+	return `Repeatedly run a read-only salt command on devices and show each device's return in a table,
+highlighting the devices whose return changed since the previous run. The devices are resolved once.
+
+Example:
+csalt watch --interval 30s "group1:" cmd.run "systemctl is-active thermal-recorder"`
+}
+
+func runWatch(argv []string) error {
+	args := WatchArgs{Interval: defaultWatchInterval, ChunkSize: defaultChunkSize}
+	parseSubcommand("watch", argv, &args)
+	if len(args.Commands) == 0 {
+		return errors.New("Commands must be specified")
+	}
+	api, server, err := connect(args.ServerArgs)
+	if err != nil {
+		return err
+	}
+	devResp, err := translateDevices(api, &args.DeviceInfo)
+	if err != nil {
+		return err
+	}
+	targets := newTargets(server, append(devResp.Devices, devResp.NameMatches...))
+	if len(targets) == 0 {
+		return errors.New("No valid devices found")
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Label() < targets[j].Label()
+	})
+	size := args.ChunkSize
+	if size <= 0 {
+		size = len(targets)
+	}
+
+	tty := stdoutIsTerminal()
+	var previous map[string]string
+	for run := 1; args.Count == 0 || run <= args.Count; run++ {
+		if run > 1 {
+			time.Sleep(args.Interval)
+		}
+		entry := newRunLogEntry(server, "salt", args.Commands)
+		entry.SetTargets(args.DeviceInfo.rawArg, targets)
+		result := &runResult{}
+		for _, chunk := range chunkTargets(targets, size) {
+			chunkResult, err := collectSalt(chunk, args.Commands, nil)
+			if err != nil {
+				entry.Finish(result.JIDs, err)
+				return err
+			}
+			result.add(chunkResult)
+		}
+		entry.Finish(result.JIDs, runError(result))
+
+		values := make(map[string]string, len(result.Results))
+		for _, res := range result.Results {
+			values[res.MinionID] = watchValue(res.Return)
+		}
+		if tty {
+			fmt.Print(clearScreen)
+		}
+		fmt.Printf("Every %v: salt %v    %v    run %v\n\n", args.Interval, strings.Join(args.Commands, " "),
+			time.Now().Format("15:04:05"), run)
+		printWatchTable(targets, values, previous, tty)
+		previous = values
+	}
+	return nil
+}
+
+// watchValue returns a device's return as a single line
+func watchValue(ret json.RawMessage) string {
+	var value interface{}
+	if err := json.Unmarshal(ret, &value); err != nil {
+		return string(ret)
+	}
+	var line string
+	if text, ok := value.(string); ok {
+		line = strings.Join(strings.Fields(text), " ")
+	} else {
+		var buf bytes.Buffer
+		json.Compact(&buf, ret)
+		line = buf.String()
+	}
+	// truncate on a rune boundary so multibyte characters aren't cut
+	if runes := []rune(line); len(runes) > maxWatchValueLen {
+		line = string(runes[:maxWatchValueLen-3]) + "..."
+	}
+	return line
+}
+
+// printWatchTable prints each target's value marking, and on a terminal highlighting, the values
+// that differ from previous
+func printWatchTable(targets []target, values, previous map[string]string, tty bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, " \tDEVICE\tMINION\tRETURN")
+	changed := 0
+	for _, t := range targets {
+		value := values[t.MinionID]
+		marker := " "
+		if old, ok := previous[t.MinionID]; ok && old != value {
+			marker = "*"
+			changed++
+		}
+		if marker == "*" && tty {
+			// tabwriter would count the escape codes as text so they only wrap the value
+			value = highlightStart + value + highlightEnd
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", marker, t.Label(), t.MinionID, value)
+	}
+	tw.Flush()
+	if previous != nil {
+		fmt.Printf("\n%v devices changed since the last run\n", changed)
+	}
+}
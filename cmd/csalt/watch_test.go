@@ -0,0 +1,45 @@
+// csalt - Wrapper for salt.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWatchValue(t *testing.T) {
+	tests := []struct {
+		ret   string
+		value string
+	}{
+		{`"up  3 days,\n load 0.1"`, "up 3 days, load 0.1"},
+		{`{"a": 1, "b": [true]}`, `{"a":1,"b":[true]}`},
+		{`not json`, "not json"},
+		{`"` + strings.Repeat("x", 100) + `"`, strings.Repeat("x", 77) + "..."},
+		{`"` + strings.Repeat("é", 100) + `"`, strings.Repeat("é", 77) + "..."},
+	}
+	for _, test := range tests {
+		value := watchValue(json.RawMessage(test.ret))
+		if value != test.value {
+			t.Errorf("watchValue(%q) = %q, want %q", test.ret, value, test.value)
+		}
+		if !utf8.ValidString(value) {
+			t.Errorf("watchValue(%q) returned invalid utf-8", test.ret)
+		}
+	}
+}
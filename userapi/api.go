@@ -24,6 +24,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"time"
 )
@@ -95,6 +96,17 @@ type Device struct {
 	GroupName  string `json:"groupname"`
 	DeviceName string `json:"devicename"`
 	SaltId     int    `json:"saltId"`
+	// Fields holds every field the API returned for the device
+	Fields map[string]interface{} `json:"-" yaml:"-"`
+}
+
+// UnmarshalJSON decodes a device keeping all of the fields returned by the API in Fields
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type device Device
+	if err := json.Unmarshal(data, (*device)(d)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.Fields)
 }
 
 type DeviceResponse struct {
@@ -104,6 +116,16 @@ type DeviceResponse struct {
 	StatusCode  int      `json:"statusCode"`
 }
 
+type Group struct {
+	GroupName string `json:"groupname"`
+}
+
+type GroupResponse struct {
+	Messages   []string `json:"messages"`
+	Groups     []Group  `json:"groups"`
+	StatusCode int      `json:"statusCode"`
+}
+
 func (api *CacophonyUserAPI) User() string {
 	return api.username
 }
@@ -136,7 +158,7 @@ func (api *CacophonyUserAPI) Authenticate(password string) error {
 		return err
 	}
 	if api.Debug {
-		fmt.Printf("Authenticate %v for user %v\n", api.authURL(), api.username)
+		fmt.Fprintf(os.Stderr, "Authenticate %v for user %v\n", api.authURL(), api.username)
 	}
 	postResp, err := api.httpClient.Post(
 		api.authURL(),
@@ -226,7 +248,7 @@ func (api *CacophonyUserAPI) TranslateNames(groups []string, devices []Device) (
 	}
 	req.URL.RawQuery = q.Encode()
 	if api.Debug {
-		fmt.Printf("TranslateNames request query:%v\n", q)
+		fmt.Fprintf(os.Stderr, "TranslateNames request query:%v\n", q)
 	}
 
 	resp, err := api.httpClient.Do(req)
@@ -247,6 +269,45 @@ func (api *CacophonyUserAPI) TranslateNames(groups []string, devices []Device) (
 	return &devResp, nil
 }
 
+// Groups returns every group the user has access to
+func (api *CacophonyUserAPI) Groups() ([]Group, error) {
+	if api.token == "" {
+		return nil, &Error{
+			message:        "No Token Supplied",
+			authentication: true,
+		}
+	}
+	req, err := http.NewRequest("GET", joinURL(api.serverURL, apiBasePath, "/groups"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", api.token)
+	q := req.URL.Query()
+	q.Add("where", "{}")
+	req.URL.RawQuery = q.Encode()
+	if api.Debug {
+		fmt.Fprintf(os.Stderr, "Groups request query:%v\n", q)
+	}
+
+	resp, err := api.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := handleHTTPResponse(resp); err != nil {
+		return nil, err
+	}
+	var groupResp GroupResponse
+	d := json.NewDecoder(resp.Body)
+	if err := d.Decode(&groupResp); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+
+	api.authenticated = true
+	return groupResp.Groups, nil
+}
+
 // newHTTPClient initializes and returns a http.Client with default settings
 func newHTTPClient() *http.Client {
 	return &http.Client{
@@ -36,15 +36,44 @@ const (
 	lockTimeout    = 5 * time.Second
 )
 
+// Executor describes how salt commands are run for a server
+type Executor struct {
+	// Type is one of sudo (default), direct, ssh, fake or salt-api
+	Type string `yaml:"type"`
+	// Host is the ssh destination of the salt master for the ssh executor
+	Host string `yaml:"host,omitempty"`
+	// Sudo runs salt with sudo on the ssh host
+	Sudo bool `yaml:"sudo,omitempty"`
+	// Script is the file of scripted responses for the fake executor
+	Script string `yaml:"script,omitempty"`
+}
+
+// SaltAPI is the salt-api rest_cherrypy server used by the salt-api executor
+type SaltAPI struct {
+	Url      string `yaml:"url"`
+	UserName string `yaml:"user-name"`
+	// EAuth is the salt external authentication system, pam by default
+	EAuth string `yaml:"eauth,omitempty"`
+}
+
 type Server struct {
-	Url        string `yaml:"url"`
-	SaltPrefix string `yaml:"salt-prefix"`
-	UserName   string `yaml:"user-name"`
+	Url            string    `yaml:"url"`
+	SaltPrefix     string    `yaml:"salt-prefix"`
+	UserName       string    `yaml:"user-name"`
+	MasterConfig   string    `yaml:"master-config,omitempty"`
+	NodeGroupFiles []string  `yaml:"nodegroup-files,omitempty"`
+	Executor       *Executor `yaml:"executor,omitempty"`
+	SaltAPI        *SaltAPI  `yaml:"salt-api,omitempty"`
+	// Canaries maps a canary alias to the DEVICEINFO of devices to try changes on first
+	Canaries map[string]string `yaml:"canaries,omitempty"`
 }
 
 type Config struct {
 	ServerURL string             `yaml:"server-url"`
 	UserName  string             `yaml:"user-name"`
+	Executor  *Executor          `yaml:"executor,omitempty"`
+	SaltAPI   *SaltAPI           `yaml:"salt-api,omitempty"`
+	Canaries  map[string]string  `yaml:"canaries,omitempty"`
 	Servers   map[string]*Server `yaml:"servers"`
 	Token     string             `yaml:"-"`
 	filePath  string
@@ -231,4 +260,20 @@ func (lockSafeConfig *LockSafeConfig) Write(data []byte) error {
 	}
 }
 
+// Append supplied data to the end of the exclusively locked file, creating it if needed
+func (lockSafeConfig *LockSafeConfig) Append(data []byte) error {
+	if !lockSafeConfig.fileLock.Locked() {
+		return fmt.Errorf("file is not locked %v", lockSafeConfig.filename)
+	}
+	file, err := Fs.OpenFile(lockSafeConfig.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 var Fs = afero.NewOsFs()